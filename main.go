@@ -18,6 +18,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = a.WatchConfig("config.json")
+	if err != nil {
+		log.Fatal(err)
+	}
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	log.Printf("Local server: http://%s", addr)
 	err = a.Run()
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/wybiral/tube/pkg/media"
+)
+
+// secretSize is the size of the secret key in bytes.
+const secretSize = 32
+
+// loadSecret returns the secret key stored in file fp, generating it first if
+// there is none. The key is kept apart from the index so password hashes
+// can't be checked against guesses without it.
+func loadSecret(fp string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fp)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) != secretSize {
+			return nil, errors.New("invalid secret file: " + fp)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, secretSize)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(fp, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// accessCookie returns the name of the cookie storing the token of a video.
+func accessCookie(v *media.Video) string {
+	h := sha256.Sum256([]byte(v.ID))
+	return "tube_" + hex.EncodeToString(h[:8])
+}
+
+// setAccessCookie stores the token granting access to a private video.
+func (a *App) setAccessCookie(w http.ResponseWriter, v *media.Video) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookie(v),
+		Value:    v.Token(a.secret),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// pathCookie returns the name of the cookie storing the token of a library
+// path.
+func pathCookie(pc *PathConfig) string {
+	h := sha256.Sum256([]byte("path\x00" + pc.Path))
+	return "tube_" + hex.EncodeToString(h[:8])
+}
+
+// pathToken returns the token granting access to the private videos of a
+// library path (empty if the path has no password), keyed with the secret of
+// the server.
+func (a *App) pathToken(pc *PathConfig) string {
+	if len(pc.Password) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(pc.Path + "\x00" + pc.Password))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// setPathCookie stores the token granting access to the private videos of a
+// library path.
+func (a *App) setPathCookie(w http.ResponseWriter, pc *PathConfig) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pathCookie(pc),
+		Value:    a.pathToken(pc),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// usesPathPassword returns true if private video v is protected by the
+// password of library path pc (rather than its own from a sidecar).
+func usesPathPassword(pc *PathConfig, v *media.Video) bool {
+	if pc == nil || len(pc.Password) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(v.Password), []byte(pc.Password)) == 1
+}
+
+// authorize returns true if request r may access video v. A valid token in
+// the query string is stored in a cookie so requests made by the page (such
+// as for the video file) are authorized as well. Unlocking the library path
+// with its password authorizes all of the videos using that password.
+func (a *App) authorize(w http.ResponseWriter, r *http.Request, v *media.Video) bool {
+	if v.Visibility != media.Private {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if len(token) > 0 && v.Authorized(a.secret, token) {
+		a.setAccessCookie(w, v)
+		return true
+	}
+	c, err := r.Cookie(accessCookie(v))
+	if err == nil && v.Authorized(a.secret, c.Value) {
+		return true
+	}
+	pc := a.Config().PathOf(v.Path)
+	if !usesPathPassword(pc, v) {
+		return false
+	}
+	c, err = r.Cookie(pathCookie(pc))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(a.pathToken(pc))) == 1
+}
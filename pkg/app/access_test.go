@@ -0,0 +1,63 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wybiral/tube/pkg/media"
+)
+
+func TestLoadSecret(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "secret.key")
+	key, err := loadSecret(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != secretSize {
+		t.Fatalf("got %d byte key", len(key))
+	}
+	info, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("secret file is readable by others (%v)", info.Mode())
+	}
+	again, err := loadSecret(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, key) {
+		t.Error("got a different key after reading it back")
+	}
+	err = ioutil.WriteFile(fp, []byte("not hex"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadSecret(fp)
+	if err == nil {
+		t.Error("got no error for invalid secret file")
+	}
+}
+
+func TestTokensAreKeyed(t *testing.T) {
+	a := &App{secret: bytes.Repeat([]byte{1}, secretSize)}
+	b := &App{secret: bytes.Repeat([]byte{2}, secretSize)}
+	v := &media.Video{ID: "v", Visibility: media.Private, Password: "pw"}
+	if !v.Authorized(a.secret, v.Token(a.secret)) {
+		t.Error("token isn't authorized")
+	}
+	if v.Authorized(a.secret, v.Token(b.secret)) {
+		t.Error("token made with another key is authorized")
+	}
+	if !v.Authorized(a.secret, "pw") {
+		t.Error("password isn't authorized")
+	}
+	pc := &PathConfig{Path: "videos", Password: "pw"}
+	if a.pathToken(pc) == b.pathToken(pc) {
+		t.Error("path tokens made with different keys are equal")
+	}
+}
@@ -0,0 +1,374 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wybiral/tube/pkg/media"
+)
+
+// maxAPIPageSize limits the number of videos returned per page by the API.
+const maxAPIPageSize = 500
+
+// apiVideo is a video as returned by the API.
+type apiVideo struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Album       string    `json:"album,omitempty"`
+	Track       int       `json:"track,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags"`
+	Timestamp   time.Time `json:"timestamp"`
+	Size        int64     `json:"size"`
+	Type        string    `json:"type"`
+	// Duration is in seconds
+	Duration   float64 `json:"duration"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	VideoCodec string  `json:"video_codec,omitempty"`
+	AudioCodec string  `json:"audio_codec,omitempty"`
+	Playable   bool    `json:"playable"`
+	Visibility string  `json:"visibility"`
+	Hash       string  `json:"hash"`
+	Downloads  bool    `json:"downloads"`
+	// Version is the library version the video last changed in
+	Version      int64         `json:"version"`
+	URL          string        `json:"url"`
+	StreamURL    string        `json:"stream_url"`
+	HLSURL       string        `json:"hls_url,omitempty"`
+	ThumbnailURL string        `json:"thumbnail_url"`
+	Captions     []*apiCaption `json:"captions"`
+}
+
+// apiCaption is a caption track of an apiVideo.
+type apiCaption struct {
+	Lang string `json:"lang"`
+	URL  string `json:"url"`
+}
+
+// apiVideoList is a page of videos returned by /api/videos.
+type apiVideoList struct {
+	Version int64 `json:"version"`
+	// Reset is set when the requested version is older than the ones known
+	// to the server so the list is complete rather than only the changes
+	Reset   bool        `json:"reset,omitempty"`
+	Total   int         `json:"total"`
+	Page    int         `json:"page"`
+	Pages   int         `json:"pages"`
+	Videos  []*apiVideo `json:"videos"`
+	Removed []string    `json:"removed,omitempty"`
+}
+
+// apiAlbum is an album returned by /api/albums.
+type apiAlbum struct {
+	Name         string `json:"name"`
+	Videos       int    `json:"videos"`
+	Version      int64  `json:"version"`
+	URL          string `json:"url"`
+	VideosURL    string `json:"videos_url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// newAPIVideo returns the API representation of video v from snap.
+func newAPIVideo(cfg *Config, snap *media.Snapshot, v *media.Video) *apiVideo {
+	visibility := v.Visibility
+	if len(visibility) == 0 {
+		visibility = media.Public
+	}
+	downloads := true
+	pc := cfg.PathOf(v.Path)
+	if pc != nil {
+		downloads = pc.AllowDownloads()
+	}
+	tags := v.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	av := &apiVideo{
+		ID:           v.ID,
+		Title:        v.Title,
+		Album:        v.Album,
+		Track:        v.Track,
+		Description:  v.Description,
+		Tags:         tags,
+		Timestamp:    v.Timestamp,
+		Size:         v.Size,
+		Type:         v.Type.ContentType(),
+		Duration:     v.Duration.Seconds(),
+		Width:        v.Width,
+		Height:       v.Height,
+		VideoCodec:   v.VideoCodec,
+		AudioCodec:   v.AudioCodec,
+		Playable:     v.Playable,
+		Visibility:   visibility,
+		Hash:         v.Hash,
+		Downloads:    downloads,
+		Version:      snap.Changes[v.ID],
+		URL:          apiURL("/v/"+v.ID, nil),
+		StreamURL:    apiURL("/v/"+v.ID+v.Type.Ext, nil),
+		ThumbnailURL: thumbURL(v),
+		Captions:     []*apiCaption{},
+	}
+	if v.HLS() {
+		av.HLSURL = apiURL("/v/"+v.ID+"/master.m3u8", nil)
+	}
+	for _, c := range v.Captions {
+		av.Captions = append(av.Captions, &apiCaption{
+			Lang: c.Lang,
+			URL:  apiURL("/c/"+v.ID+"/"+c.Lang+".vtt", nil),
+		})
+	}
+	return av
+}
+
+// apiURL returns the escaped URL of a path with query q (if not nil).
+func apiURL(p string, q url.Values) string {
+	u := &url.URL{Path: p}
+	if q != nil {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// thumbURL returns the URL of the thumbnail of v.
+func thumbURL(v *media.Video) string {
+	if len(v.ThumbHash) == 0 {
+		return apiURL("/t/"+v.ID, nil)
+	}
+	return apiURL("/t/"+v.ID, url.Values{"v": {v.ThumbHash}})
+}
+
+// writeJSON writes v as JSON with an ETag of its contents, responding with
+// 304 Not Modified instead if the ETag matches If-None-Match.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		apiError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	h := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(h[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// apiError writes an error message as JSON.
+func apiError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// HTTP handler for /api/videos?q=query&album=album&prefix=prefix&tag=tag
+// (also taking sort, since, page and page_size)
+func (a *App) apiVideosHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("/api/videos?%s", r.URL.RawQuery)
+	cfg := a.Config()
+	q := r.URL.Query()
+	snap := a.Library.Snapshot()
+	var pl media.Playlist
+	order := requestSort(q, "")
+	switch {
+	case len(q.Get("q")) > 0:
+		// search results are in order of relevance unless sorted
+		pl = a.Library.Search(q.Get("q"))
+	case len(q.Get("album")) > 0:
+		// album episodes are in episode order unless sorted
+		pl = snap.Albums[q.Get("album")]
+	default:
+		// the library is presorted in every order
+		pl = snap.Sorted(requestSort(q, cfg.Playlist.Sort))
+		order = ""
+	}
+	pl = filterVideos(pl, q)
+	if len(order) > 0 {
+		pl = pl.Sorted(order)
+	}
+	list := &apiVideoList{Version: snap.Version}
+	since := q.Get("since")
+	if len(since) > 0 {
+		version, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			apiError(w, "Invalid since version", http.StatusBadRequest)
+			return
+		}
+		if version < snap.Base {
+			// changes before the server started aren't known
+			list.Reset = true
+		} else {
+			pl, list.Removed = snap.ChangedSince(pl, version, inView(q))
+		}
+	}
+	size := cfg.Playlist.PageSize
+	if len(q.Get("page_size")) > 0 {
+		size, _ = strconv.Atoi(q.Get("page_size"))
+	}
+	if size < 1 || size > maxAPIPageSize {
+		size = maxAPIPageSize
+	}
+	list.Total = len(pl)
+	list.Pages = pl.Pages(size)
+	list.Page, _ = strconv.Atoi(q.Get("page"))
+	if list.Page < 1 {
+		list.Page = 1
+	}
+	list.Videos = []*apiVideo{}
+	for _, v := range pl.Page(list.Page, size) {
+		list.Videos = append(list.Videos, newAPIVideo(cfg, snap, v))
+	}
+	writeJSON(w, r, list)
+}
+
+// filterVideos returns the videos of pl matching the album, prefix and tag
+// filters of query q.
+func filterVideos(pl media.Playlist, q url.Values) media.Playlist {
+	if len(q.Get("album")) == 0 && len(q.Get("prefix")) == 0 && len(q.Get("tag")) == 0 {
+		return pl
+	}
+	match := filterMatch(q)
+	filtered := media.Playlist{}
+	for _, v := range pl {
+		if match(v) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+// filterMatch returns a function matching videos by the album, prefix and
+// tag filters of query q.
+func filterMatch(q url.Values) func(*media.Video) bool {
+	album := q.Get("album")
+	prefix := strings.Trim(q.Get("prefix"), "/")
+	tag := q.Get("tag")
+	return func(v *media.Video) bool {
+		if len(album) > 0 && !strings.EqualFold(v.Album, album) {
+			return false
+		}
+		if len(prefix) > 0 && !strings.HasPrefix(v.ID, prefix+"/") {
+			return false
+		}
+		if len(tag) > 0 && !hasTag(v, tag) {
+			return false
+		}
+		return true
+	}
+}
+
+// inView returns a function matching the listed videos that belong in the
+// /api/videos view of query q.
+func inView(q url.Values) func(*media.Video) bool {
+	match := filterMatch(q)
+	search := q.Get("q")
+	album := q.Get("album")
+	var query *media.Query
+	if len(search) > 0 {
+		query = media.ParseQuery(search)
+	}
+	return func(v *media.Video) bool {
+		switch {
+		case query != nil:
+			// searches without terms or filters find nothing
+			if len(query.Terms) == 0 && len(query.Album) == 0 && len(query.Prefix) == 0 {
+				return false
+			}
+			if !query.MatchesAll(v) {
+				return false
+			}
+		case len(album) > 0:
+			if v.Album != album {
+				return false
+			}
+		}
+		return match(v)
+	}
+}
+
+// hasTag returns true if v is tagged with tag (ignoring case).
+func hasTag(v *media.Video, tag string) bool {
+	for _, t := range v.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP handler for /api/videos/id
+func (a *App) apiVideoHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log.Printf("/api/videos/%s", id)
+	v, ok := a.lookup(id)
+	if !ok {
+		to, moved := a.Library.Redirect(id)
+		if moved {
+			http.Redirect(w, r, apiURL("/api/videos/"+to, nil), http.StatusMovedPermanently)
+			return
+		}
+		apiError(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !a.authorize(w, r, v) {
+		apiError(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if v.Visibility == media.Private {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	writeJSON(w, r, newAPIVideo(a.Config(), a.Library.Snapshot(), v))
+}
+
+// HTTP handler for /api/albums
+func (a *App) apiAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("/api/albums")
+	snap := a.Library.Snapshot()
+	list := struct {
+		Version int64       `json:"version"`
+		Albums  []*apiAlbum `json:"albums"`
+	}{
+		Version: snap.Version,
+		Albums:  []*apiAlbum{},
+	}
+	for name, episodes := range snap.Albums {
+		album := &apiAlbum{
+			Name:         name,
+			Videos:       len(episodes),
+			URL:          apiURL("/a/"+name, nil),
+			VideosURL:    apiURL("/api/videos", url.Values{"album": {name}}),
+			ThumbnailURL: thumbURL(episodes[0]),
+		}
+		for _, v := range episodes {
+			if snap.Changes[v.ID] > album.Version {
+				album.Version = snap.Changes[v.ID]
+			}
+		}
+		list.Albums = append(list.Albums, album)
+	}
+	sort.Slice(list.Albums, func(i, j int) bool {
+		return strings.ToLower(list.Albums[i].Name) < strings.ToLower(list.Albums[j].Name)
+	})
+	writeJSON(w, r, list)
+}
@@ -2,30 +2,39 @@
 package app
 
 import (
-	"errors"
-	"fmt"
+	"encoding/json"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
-	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/mux"
 	"github.com/wybiral/tube/pkg/media"
-	"github.com/wybiral/tube/pkg/onionkey"
 )
 
 // App represents main application.
 type App struct {
-	Config    *Config
+	// config holds the current *Config (see Config)
+	config    atomic.Value
 	Library   *media.Library
-	Watcher   *fsnotify.Watcher
+	Thumbs    *media.ThumbCache
+	HLS       *media.HLSCache
+	Watcher   *Watcher
 	Templates *template.Template
-	Feed      []byte
-	Tor       *tor
-	Listener  net.Listener
-	Router    *mux.Router
+	// Feed holds the RSS feed as a []byte once it's been built
+	Feed atomic.Value
+	// mu guards Tor once the server is running
+	mu       sync.Mutex
+	Tor      *tor
+	Listener net.Listener
+	Router   *mux.Router
+	// secret keys password hashes and access tokens
+	secret []byte
 }
 
 // NewApp returns a new instance of App from Config.
@@ -33,13 +42,36 @@ func NewApp(cfg *Config) (*App, error) {
 	if cfg == nil {
 		cfg = DefaultConfig()
 	}
-	a := &App{
-		Config: cfg,
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	a := &App{}
+	a.config.Store(cfg)
+	secret, err := loadSecret(cfg.Secret)
+	if err != nil {
+		return nil, err
 	}
+	a.secret = secret
 	// Setup Library
 	a.Library = media.NewLibrary()
+	a.Library.Workers = cfg.ImportWorkers
+	if len(cfg.Index) > 0 {
+		idx, err := media.OpenIndex(cfg.Index, a.secret)
+		if err != nil {
+			return nil, err
+		}
+		a.Library.SetIndex(idx)
+	}
+	// Setup Thumbnails
+	thumbs, err := media.NewThumbCache(cfg.Thumbs, cfg.ThumbMemory<<20)
+	if err != nil {
+		return nil, err
+	}
+	a.Thumbs = thumbs
+	a.HLS = media.NewHLSCache(hlsCacheMemory)
 	// Setup Watcher
-	w, err := fsnotify.NewWatcher()
+	w, err := NewWatcher()
 	if err != nil {
 		return nil, err
 	}
@@ -63,13 +95,26 @@ func NewApp(cfg *Config) (*App, error) {
 	// Setup Router
 	r := mux.NewRouter().StrictSlash(true)
 	r.HandleFunc("/", a.indexHandler).Methods("GET")
-	r.HandleFunc("/v/{id}.mp4", a.videoHandler).Methods("GET")
-	r.HandleFunc("/v/{prefix}/{id}.mp4", a.videoHandler).Methods("GET")
-	r.HandleFunc("/t/{id}", a.thumbHandler).Methods("GET")
-	r.HandleFunc("/t/{prefix}/{id}", a.thumbHandler).Methods("GET")
-	r.HandleFunc("/v/{id}", a.pageHandler).Methods("GET")
-	r.HandleFunc("/v/{prefix}/{id}", a.pageHandler).Methods("GET")
+	// IDs may contain any number of slashes (prefix and subdirectories)
+	exts := strings.Join(media.Exts(), "|")
+	// HLS routes come first so they aren't taken for video IDs
+	r.HandleFunc("/v/{id:.+}/master.m3u8", a.hlsMasterHandler).Methods("GET")
+	r.HandleFunc("/v/{id:.+}/index.m3u8", a.hlsPlaylistHandler).Methods("GET")
+	r.HandleFunc("/v/{id:.+}/init.m4s", a.hlsInitHandler).Methods("GET")
+	r.HandleFunc("/v/{id:.+}/{n:[0-9]+}.m4s", a.hlsSegmentHandler).Methods("GET")
+	r.HandleFunc("/v/{id:.+}.{ext:"+exts+"}", a.videoHandler).Methods("GET")
+	r.HandleFunc("/c/{id:.+}/{lang}.vtt", a.captionHandler).Methods("GET")
+	r.HandleFunc("/t/{id:.+}", a.thumbHandler).Methods("GET")
+	r.HandleFunc("/v/{id:.+}", a.pageHandler).Methods("GET")
+	r.HandleFunc("/v/{id:.+}", a.unlockHandler).Methods("POST")
+	r.HandleFunc("/a/{album:.+}", a.albumHandler).Methods("GET")
+	r.HandleFunc("/p/{prefix:.*}", a.channelHandler).Methods("GET")
+	r.HandleFunc("/search", a.searchHandler).Methods("GET")
 	r.HandleFunc("/feed.xml", a.rssHandler).Methods("GET")
+	r.HandleFunc("/status", a.statusHandler).Methods("GET")
+	r.HandleFunc("/api/videos", a.apiVideosHandler).Methods("GET")
+	r.HandleFunc("/api/videos/{id:.+}", a.apiVideoHandler).Methods("GET")
+	r.HandleFunc("/api/albums", a.apiAlbumsHandler).Methods("GET")
 	// Static file handler
 	fsHandler := http.StripPrefix(
 		"/static/",
@@ -80,143 +125,416 @@ func NewApp(cfg *Config) (*App, error) {
 	return a, nil
 }
 
-// Run imports the library and starts server.
+// Run starts the server and imports the library in the background.
 func (a *App) Run() error {
 	if a.Tor != nil {
-		var err error
-		cs := a.Config.Server
-		key := a.Tor.OnionKey
-		if key == nil {
-			key, err = onionkey.GenerateKey()
-			if err != nil {
-				return err
-			}
-			a.Tor.OnionKey = key
-		}
-		onion, err := key.Onion()
+		err := a.Tor.start(a.Config().Server)
 		if err != nil {
 			return err
 		}
-		onion.Ports[80] = fmt.Sprintf("%s:%d", cs.Host, cs.Port)
-		err = a.Tor.Controller.AddOnion(onion)
-		if err != nil {
-			return errors.New("unable to start Tor onion service")
-		}
-		log.Printf("Onion service: http://%s.onion", onion.ServiceID)
 	}
-	for _, pc := range a.Config.Library {
-		p := &media.Path{
-			Path:   pc.Path,
-			Prefix: pc.Prefix,
-		}
-		err := a.Library.AddPath(p)
+	var paths []*media.Path
+	for _, pc := range a.Config().Library {
+		p, err := a.addPath(pc)
 		if err != nil {
 			return err
 		}
-		err = a.Library.Import(p)
+		paths = append(paths, p)
+	}
+	go handleEvents(a, a.Library.Subscribe())
+	go a.importLibrary(paths)
+	return http.Serve(a.Listener, a.Router)
+}
+
+// serviceID returns the address of the onion service (empty if it's not
+// running).
+func (a *App) serviceID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.Tor == nil {
+		return ""
+	}
+	return a.Tor.ServiceID
+}
+
+// Config returns the current Config (which may be replaced by reloading).
+func (a *App) Config() *Config {
+	return a.config.Load().(*Config)
+}
+
+// addPath adds a library path to the Library and watches it for changes.
+func (a *App) addPath(pc *PathConfig) (*media.Path, error) {
+	p := newPath(pc)
+	err := a.Library.AddPath(p)
+	if err != nil {
+		return nil, err
+	}
+	err = a.Watcher.Add(p, time.Duration(pc.Poll)*time.Second)
+	if err != nil {
+		a.Watcher.Remove(p.Path)
+		a.Library.RemovePath(p.Path)
+		return nil, err
+	}
+	return p, nil
+}
+
+// newPath returns the media.Path of library path pc.
+func newPath(pc *PathConfig) *media.Path {
+	p := &media.Path{
+		Path:       pc.Path,
+		Prefix:     pc.Prefix,
+		IDMode:     pc.IDMode,
+		Visibility: pc.visibility(),
+		Password:   pc.Password,
+	}
+	if pc.S3 != nil {
+		p.Storage = &media.S3Storage{
+			Root:      pc.Path,
+			Endpoint:  pc.S3.Endpoint,
+			Region:    pc.S3.Region,
+			Bucket:    pc.S3.Bucket,
+			Prefix:    pc.S3.Prefix,
+			AccessKey: pc.S3.AccessKey,
+			SecretKey: pc.S3.SecretKey,
+		}
+	}
+	return p
+}
+
+// importLibrary imports library paths and starts handling changes to them
+// once done.
+func (a *App) importLibrary(paths []*media.Path) {
+	for _, p := range paths {
+		err := a.Library.Import(p)
 		if err != nil {
-			return err
+			log.Println("Import error:", p.Path, err)
 		}
-		a.Watcher.Add(p.Path)
 	}
+	// drop entries for files deleted while the server wasn't running
+	a.Library.PruneIndex()
+	a.Library.Publish()
 	buildFeed(a)
-	go startWatcher(a)
-	return http.Serve(a.Listener, a.Router)
+	saveIndex(a)
+	startWatcher(a)
+}
+
+// lookup returns a video by ID unless it's scheduled to be published later.
+func (a *App) lookup(id string) (*media.Video, bool) {
+	v, ok := a.Library.Snapshot().Video(id)
+	if !ok || !v.Released() {
+		return nil, false
+	}
+	return v, true
 }
 
 // HTTP handler for /
 func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("/")
-	pl := a.Library.Playlist()
+	cfg := a.Config().Playlist
+	p := newPage(r, nil)
+	pl := p.library(a.Library.Snapshot(), cfg.Sort)
 	if len(pl) > 0 {
-		http.Redirect(w, r, "/v/"+pl[0].ID, 302)
+		http.Redirect(w, r, p.Link(pl[0].ID), 302)
 	} else {
-		a.Templates.ExecuteTemplate(w, "index.html", &struct {
-			Playing  *media.Video
-			Playlist media.Playlist
-		}{
-			Playing:  &media.Video{ID: ""},
-			Playlist: a.Library.Playlist(),
-		})
+		p.setPlaylist(pl, cfg.PageSize)
+		a.Templates.ExecuteTemplate(w, "index.html", p)
 	}
 }
 
 // HTTP handler for /v/id
 func (a *App) pageHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-	prefix, ok := vars["prefix"]
-	if ok {
-		id = path.Join(prefix, id)
-	}
+	id := mux.Vars(r)["id"]
 	log.Printf("/v/%s", id)
-	playing, ok := a.Library.Videos[id]
+	cfg := a.Config().Playlist
+	playing, ok := a.lookup(id)
 	if !ok {
-		a.Templates.ExecuteTemplate(w, "index.html", &struct {
-			Playing  *media.Video
-			Playlist media.Playlist
-		}{
-			Playing:  &media.Video{ID: ""},
-			Playlist: a.Library.Playlist(),
-		})
+		to, ok := a.Library.Redirect(id)
+		if ok {
+			http.Redirect(w, r, "/v/"+to, http.StatusMovedPermanently)
+			return
+		}
+		p := newPage(r, nil)
+		p.setPlaylist(p.library(a.Library.Snapshot(), cfg.Sort), cfg.PageSize)
+		a.Templates.ExecuteTemplate(w, "index.html", p)
+		return
+	}
+	if !a.authorize(w, r, playing) {
+		a.lockedPage(w, r, playing, "")
 		return
 	}
+	p := newPage(r, playing)
+	pc := a.Config().PathOf(playing.Path)
+	if pc != nil {
+		p.Channel = newChannel(pc)
+		p.Downloads = pc.AllowDownloads()
+	}
+	if len(playing.Album) > 0 {
+		// limit playlist to the album and link neighbouring episodes
+		p.Album = playing.Album
+		episodes := a.Library.Album(playing.Album)
+		for i, v := range episodes {
+			if v.ID != playing.ID {
+				continue
+			}
+			if i > 0 {
+				p.Prev = episodes[i-1]
+			}
+			if i < len(episodes)-1 {
+				p.Next = episodes[i+1]
+			}
+		}
+		p.setPlaylist(p.sort(episodes, ""), cfg.PageSize)
+	} else {
+		p.setPlaylist(p.library(a.Library.Snapshot(), cfg.Sort), cfg.PageSize)
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	a.Templates.ExecuteTemplate(w, "index.html", &struct {
-		Playing  *media.Video
-		Playlist media.Playlist
-	}{
-		Playing:  playing,
-		Playlist: a.Library.Playlist(),
-	})
+	a.Templates.ExecuteTemplate(w, "index.html", p)
 }
 
-// HTTP handler for /v/id.mp4
+// HTTP handler for POST /v/id (password form of private videos)
+func (a *App) unlockHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	log.Printf("POST /v/%s", id)
+	playing, ok := a.lookup(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !playing.Authorized(a.secret, r.PostFormValue("password")) {
+		a.lockedPage(w, r, playing, "Incorrect password")
+		return
+	}
+	pc := a.Config().PathOf(playing.Path)
+	if usesPathPassword(pc, playing) {
+		a.setPathCookie(w, pc)
+	} else {
+		a.setAccessCookie(w, playing)
+	}
+	http.Redirect(w, r, "/v/"+playing.ID, http.StatusSeeOther)
+}
+
+// lockedPage renders the password form of a private video.
+func (a *App) lockedPage(w http.ResponseWriter, r *http.Request, v *media.Video, msg string) {
+	p := newPage(r, v)
+	p.Locked = true
+	p.Error = msg
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	a.Templates.ExecuteTemplate(w, "index.html", p)
+}
+
+// HTTP handler for /a/album
+func (a *App) albumHandler(w http.ResponseWriter, r *http.Request) {
+	album := mux.Vars(r)["album"]
+	log.Printf("/a/%s", album)
+	pl := a.Library.Album(album)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if len(pl) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	p := newPage(r, nil)
+	p.Album = album
+	p.setPlaylist(p.sort(pl, ""), a.Config().Playlist.PageSize)
+	a.Templates.ExecuteTemplate(w, "index.html", p)
+}
+
+// HTTP handler for /p/prefix
+func (a *App) channelHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := mux.Vars(r)["prefix"]
+	log.Printf("/p/%s", prefix)
+	cfg := a.Config()
+	var ch *channel
+	for _, pc := range cfg.Library {
+		if strings.Trim(pc.Prefix, "/") == prefix {
+			ch = newChannel(pc)
+			break
+		}
+	}
+	if ch == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	p := newPage(r, nil)
+	p.Channel = ch
+	pl := a.Library.Snapshot().Prefixes[prefix]
+	p.setPlaylist(p.sort(pl, cfg.Playlist.Sort), cfg.Playlist.PageSize)
+	a.Templates.ExecuteTemplate(w, "index.html", p)
+}
+
+// HTTP handler for /search?q=query
+func (a *App) searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	log.Printf("/search?q=%s", q)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	p := newPage(r, nil)
+	p.Query = q
+	p.setPlaylist(p.sort(a.Library.Search(q), ""), a.Config().Playlist.PageSize)
+	a.Templates.ExecuteTemplate(w, "index.html", p)
+}
+
+// HTTP handler for /v/id.ext
 func (a *App) videoHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	prefix, ok := vars["prefix"]
-	if ok {
-		id = path.Join(prefix, id)
-	}
-	log.Printf("/v/%s", id)
-	m, ok := a.Library.Videos[id]
+	log.Printf("/v/%s.%s", id, vars["ext"])
+	m, ok := a.lookup(id)
 	if !ok {
+		to, moved := a.Library.Redirect(id)
+		m, ok = a.lookup(to)
+		if moved && ok {
+			http.Redirect(w, r, "/v/"+m.ID+m.Type.Ext, http.StatusMovedPermanently)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if m.Type.Ext != "."+vars["ext"] {
+		http.NotFound(w, r)
+		return
+	}
+	if !a.authorize(w, r, m) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 	title := m.Title
-	disposition := "attachment; filename=\"" + title + ".mp4\""
+	disposition := "attachment; filename=\"" + title + m.Type.Ext + "\""
+	pc := a.Config().PathOf(m.Path)
+	if pc != nil && !pc.AllowDownloads() {
+		disposition = "inline"
+	}
 	w.Header().Set("Content-Disposition", disposition)
-	w.Header().Set("Content-Type", "video/mp4")
-	http.ServeFile(w, r, m.Path)
+	w.Header().Set("Content-Type", m.Type.MIMEType)
+	f, err := a.Library.Storage(m.Path).Open(m.Path)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// serves range requests so videos can be seeked
+	http.ServeContent(w, r, m.Path, info.ModTime(), f)
 }
 
-// HTTP handler for /t/id
-func (a *App) thumbHandler(w http.ResponseWriter, r *http.Request) {
+// HTTP handler for /c/id/lang.vtt
+func (a *App) captionHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	prefix, ok := vars["prefix"]
-	if ok {
-		id = path.Join(prefix, id)
+	lang := vars["lang"]
+	log.Printf("/c/%s/%s.vtt", id, lang)
+	m, ok := a.lookup(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
 	}
+	if !a.authorize(w, r, m) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	c, ok := m.Caption(lang)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	err := c.WriteVTT(w, a.Library.Storage(c.Path))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// HTTP handler for /t/id?w=width&v=hash
+func (a *App) thumbHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
 	log.Printf("/t/%s", id)
-	m, ok := a.Library.Videos[id]
+	m, ok := a.lookup(id)
 	if !ok {
 		return
 	}
-	w.Header().Set("Cache-Control", "public, max-age=7776000")
+	if !a.authorize(w, r, m) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	cache := "public"
+	if m.Visibility == media.Private {
+		cache = "private"
+	}
+	// URLs including the thumbnail hash change with the thumbnail so they
+	// can be cached for a long time
+	if len(m.ThumbHash) > 0 && q.Get("v") == m.ThumbHash {
+		w.Header().Set("Cache-Control", cache+", max-age=7776000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", cache+", no-cache")
+	}
 	if m.ThumbType == "" {
 		w.Header().Set("Content-Type", "image/jpeg")
 		http.ServeFile(w, r, "static/defaulticon.jpg")
+		return
+	}
+	width, err := strconv.Atoi(q.Get("w"))
+	if err == nil && width > 0 {
+		width = media.ThumbWidth(width)
 	} else {
-		w.Header().Set("Content-Type", m.ThumbType)
-		w.Write(m.Thumb)
+		width = 0
 	}
+	s := a.Library.Storage(m.ThumbPath)
+	data, typ, err := a.Thumbs.Get(s, m, width)
+	if err != nil && width > 0 {
+		// fall back to the original if it can't be resized
+		log.Println(err)
+		data, typ, err = a.Thumbs.Get(s, m, 0)
+	}
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeFile(w, r, "static/defaulticon.jpg")
+		return
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Write(data)
 }
 
 // HTTP handler for /feed.xml
 func (a *App) rssHandler(w http.ResponseWriter, r *http.Request) {
+	feed, ok := a.Feed.Load().([]byte)
+	if !ok {
+		// the library is still being imported
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Feed not ready", http.StatusServiceUnavailable)
+		return
+	}
 	w.Header().Set("Cache-Control", "public, max-age=7776000")
 	w.Header().Set("Content-Type", "text/xml")
-	w.Write(a.Feed)
+	w.Write(feed)
+}
+
+// HTTP handler for /status
+func (a *App) statusHandler(w http.ResponseWriter, r *http.Request) {
+	// only listed videos are counted so unlisted and private videos aren't
+	// revealed, and the local paths of files that failed are only shown
+	// when enabled in the server config
+	s := a.Library.ImportStatus()
+	if !a.Config().Server.StatusErrors {
+		s.Errors = nil
+	}
+	status := struct {
+		Videos int                `json:"videos"`
+		Import media.ImportStatus `json:"import"`
+	}{
+		Videos: len(a.Library.Snapshot().Playlist()),
+		Import: s,
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Println(err)
+	}
 }
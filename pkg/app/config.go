@@ -2,27 +2,97 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wybiral/tube/pkg/media"
 )
 
 // Config settings for main App.
 type Config struct {
-	Library []*PathConfig `json:"library"`
-	Server  *ServerConfig `json:"server"`
-	Feed    *FeedConfig   `json:"feed"`
-	Tor     *TorConfig    `json:"tor,omitempty"`
+	Library       []*PathConfig   `json:"library"`
+	Index         string          `json:"index"`
+	Secret        string          `json:"secret"`
+	Thumbs        string          `json:"thumbnails"`
+	ThumbMemory   int             `json:"thumbnail_memory"`
+	ImportWorkers int             `json:"import_workers"`
+	Server        *ServerConfig   `json:"server"`
+	Playlist      *PlaylistConfig `json:"playlist"`
+	Feed          *FeedConfig     `json:"feed"`
+	Tor           *TorConfig      `json:"tor,omitempty"`
 }
 
 // PathConfig settings for media library path.
 type PathConfig struct {
 	Path   string `json:"path"`
 	Prefix string `json:"prefix"`
+	// IDMode is one of "filename" (default), "hash" or "sidecar"
+	IDMode string `json:"id,omitempty"`
+	// Name and Description are shown in the channel section of the path
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Visibility is the default for videos: "public", "unlisted" or "private"
+	// (private when a Password is set)
+	Visibility string `json:"visibility,omitempty"`
+	// Password grants access to the private videos of the path
+	Password string `json:"password,omitempty"`
+	// Downloads offers videos to be downloaded (true when missing)
+	Downloads *bool `json:"downloads,omitempty"`
+	// Feed includes videos in the RSS feed (true when missing)
+	Feed *bool `json:"feed,omitempty"`
+	// Poll is the interval (in seconds) to scan the path for changes instead
+	// of watching it, for network and FUSE filesystems where changes can't
+	// be watched (S3 paths are always polled, every 60 seconds by default)
+	Poll int `json:"poll,omitempty"`
+	// S3 serves the path from an S3-compatible object store instead of the
+	// local filesystem
+	S3 *S3Config `json:"s3,omitempty"`
+}
+
+// visibility returns the default visibility of videos in the path.
+func (pc *PathConfig) visibility() string {
+	if len(pc.Visibility) == 0 && len(pc.Password) > 0 {
+		return media.Private
+	}
+	return pc.Visibility
+}
+
+// AllowDownloads returns true if videos in the path may be downloaded.
+func (pc *PathConfig) AllowDownloads() bool {
+	return pc.Downloads == nil || *pc.Downloads
+}
+
+// InFeed returns true if videos in the path are included in the RSS feed.
+func (pc *PathConfig) InFeed() bool {
+	return pc.Feed == nil || *pc.Feed
+}
+
+// S3Config settings for an S3-compatible object store.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
 }
 
 // ServerConfig settings for App Server.
 type ServerConfig struct {
 	Host string `json:"host"`
 	Port int    `json:"port"`
+	// StatusErrors includes the paths and errors of files that failed to
+	// import in /status
+	StatusErrors bool `json:"status_errors,omitempty"`
+}
+
+// PlaylistConfig settings for listing videos.
+type PlaylistConfig struct {
+	Sort     string `json:"sort"`
+	PageSize int    `json:"page_size"`
 }
 
 // FeedConfig settings for App Feed.
@@ -60,10 +130,19 @@ func DefaultConfig() *Config {
 				Prefix: "",
 			},
 		},
+		Index:         "index.json",
+		Secret:        "secret.key",
+		Thumbs:        "thumbnails",
+		ThumbMemory:   32,
+		ImportWorkers: 0,
 		Server: &ServerConfig{
 			Host: "127.0.0.1",
 			Port: 0,
 		},
+		Playlist: &PlaylistConfig{
+			Sort:     "date",
+			PageSize: 50,
+		},
 		Feed: &FeedConfig{
 			ExternalURL: "http://localhost",
 		},
@@ -77,6 +156,22 @@ func DefaultConfig() *Config {
 	}
 }
 
+// PathOf returns the settings of the library path containing file path fp,
+// the most specific one when paths are nested (nil if there is none).
+func (c *Config) PathOf(fp string) *PathConfig {
+	fp = filepath.ToSlash(fp)
+	var found *PathConfig
+	n := 0
+	for _, pc := range c.Library {
+		dir := filepath.ToSlash(filepath.Clean(pc.Path))
+		if strings.HasPrefix(fp, dir+"/") && len(dir) > n {
+			found = pc
+			n = len(dir)
+		}
+	}
+	return found
+}
+
 // ReadFile reads a JSON file into Config.
 func (c *Config) ReadFile(path string) error {
 	f, err := os.Open(path)
@@ -87,3 +182,54 @@ func (c *Config) ReadFile(path string) error {
 	d := json.NewDecoder(f)
 	return d.Decode(c)
 }
+
+// Validate returns an error if any of the settings are invalid.
+func (c *Config) Validate() error {
+	if c.Server == nil || c.Playlist == nil || c.Feed == nil || c.Tor == nil {
+		return errors.New("config: missing section")
+	}
+	if len(c.Secret) == 0 {
+		return errors.New("config: missing secret file")
+	}
+	paths := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for _, pc := range c.Library {
+		if pc == nil || len(pc.Path) == 0 {
+			return errors.New("config: missing library path")
+		}
+		if paths[pc.Path] {
+			return fmt.Errorf("config: duplicate library path %q", pc.Path)
+		}
+		paths[pc.Path] = true
+		if prefixes[pc.Prefix] {
+			return fmt.Errorf("config: duplicate library prefix %q", pc.Prefix)
+		}
+		prefixes[pc.Prefix] = true
+		switch pc.IDMode {
+		case "", media.IDFilename, media.IDHash, media.IDSidecar:
+		default:
+			return fmt.Errorf("config: invalid id mode %q", pc.IDMode)
+		}
+		switch pc.Visibility {
+		case "", media.Public, media.Unlisted, media.Private:
+		default:
+			return fmt.Errorf("config: invalid visibility %q", pc.Visibility)
+		}
+		if pc.Poll < 0 {
+			return fmt.Errorf("config: invalid poll interval for %q", pc.Path)
+		}
+		if pc.S3 != nil && (len(pc.S3.Endpoint) == 0 || len(pc.S3.Bucket) == 0) {
+			return fmt.Errorf("config: missing S3 endpoint or bucket for %q", pc.Path)
+		}
+	}
+	if len(c.Playlist.Sort) > 0 && !media.IsSortOrder(c.Playlist.Sort) {
+		return fmt.Errorf("config: invalid playlist sort %q", c.Playlist.Sort)
+	}
+	if c.Playlist.PageSize < 0 {
+		return errors.New("config: invalid playlist page size")
+	}
+	if c.Tor.Enable && c.Tor.Controller == nil {
+		return errors.New("config: missing Tor controller")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"time"
+
+	"github.com/wybiral/tube/pkg/media"
+)
+
+// eventDelay is how long to wait for more library events before reacting to
+// them so a batch of changes is handled at once.
+const eventDelay = 100 * time.Millisecond
+
+// handleEvents reacts to library changes by rebuilding the feed and evicting
+// thumbnails that are no longer used.
+func handleEvents(a *App, sub *media.Subscription) {
+	for e := range sub.C {
+		events := []media.Event{e}
+		timer := time.NewTimer(eventDelay)
+	collect:
+		for {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					break collect
+				}
+				events = append(events, e)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		evictThumbs(a, events)
+		rebuildFeed(a)
+	}
+}
+
+// evictThumbs removes cached thumbnails of removed or updated videos that
+// aren't used by any video anymore.
+func evictThumbs(a *App, events []media.Event) {
+	var stale []string
+	for _, e := range events {
+		switch {
+		case e.Type == media.Removed:
+			stale = append(stale, e.Video.ThumbHash)
+		case e.Type == media.Updated && e.Old.ThumbHash != e.Video.ThumbHash:
+			stale = append(stale, e.Old.ThumbHash)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	used := make(map[string]bool)
+	for _, v := range a.Library.Snapshot().Videos {
+		used[v.ThumbHash] = true
+	}
+	for _, hash := range stale {
+		if len(hash) > 0 && !used[hash] {
+			a.Thumbs.Evict(hash)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/xml"
 	"fmt"
 	"net/url"
 	"os"
@@ -9,11 +10,12 @@ import (
 	"time"
 
 	"github.com/wybiral/feeds"
+	"github.com/wybiral/tube/pkg/media"
 )
 
 // buildFeed creates RSS feed attribute for App based on Library contents.
 func buildFeed(a *App) {
-	cfg := a.Config.Feed
+	cfg := a.Config().Feed
 	now := time.Now()
 	f := &feeds.Feed{
 		Title:       cfg.Title,
@@ -29,23 +31,26 @@ func buildFeed(a *App) {
 	var externalURL string
 	if len(cfg.ExternalURL) > 0 {
 		externalURL = cfg.ExternalURL
-	} else if a.Tor != nil {
-		onion, err := a.Tor.OnionKey.Onion()
-		if err != nil {
-			return
-		}
-		externalURL = fmt.Sprintf("http://%s.onion", onion.ServiceID)
+	} else if id := a.serviceID(); len(id) > 0 {
+		externalURL = fmt.Sprintf("http://%s.onion", id)
 	} else {
 		hostname, err := os.Hostname()
 		if err != nil {
-			host := a.Config.Server.Host
-			port := a.Config.Server.Port
+			host := a.Config().Server.Host
+			port := a.Config().Server.Port
 			externalURL = fmt.Sprintf("http://%s:%d", host, port)
 		} else {
 			externalURL = fmt.Sprintf("http://%s", hostname)
 		}
 	}
+	var pl media.Playlist
 	for _, v := range a.Library.Playlist() {
+		pc := a.Config().PathOf(v.Path)
+		if pc == nil || pc.InFeed() {
+			pl = append(pl, v)
+		}
+	}
+	for _, v := range pl {
 		u, err := url.Parse(externalURL)
 		if err != nil {
 			return
@@ -58,9 +63,9 @@ func buildFeed(a *App) {
 			Link:        &feeds.Link{Href: id},
 			Description: v.Description,
 			Enclosure: &feeds.Enclosure{
-				Url:    id + ".mp4",
+				Url:    id + v.Type.Ext,
 				Length: strconv.FormatInt(v.Size, 10),
-				Type:   "video/mp4",
+				Type:   v.Type.MIMEType,
 			},
 			Author: &feeds.Author{
 				Name:  cfg.Author.Name,
@@ -69,9 +74,53 @@ func buildFeed(a *App) {
 			Created: v.Timestamp,
 		})
 	}
-	feed, err := f.ToRss()
+	// wrap the generated channel to add iTunes durations to items
+	channel := &rssChannel{RssFeed: (&feeds.Rss{Feed: f}).RssFeed()}
+	for i, item := range channel.RssFeed.Items {
+		ri := &rssItem{RssItem: item}
+		if pl[i].Duration > 0 {
+			ri.Duration = strconv.Itoa(int(pl[i].Duration.Seconds()))
+		}
+		channel.Items = append(channel.Items, ri)
+	}
+	channel.RssFeed.Items = nil
+	feed, err := xml.MarshalIndent(&rss{
+		Version:         "2.0",
+		ITunesNamespace: "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel:         channel,
+	}, "", "  ")
 	if err != nil {
 		return
 	}
-	a.Feed = []byte(feed)
+	a.Feed.Store(append([]byte(xml.Header), feed...))
+}
+
+// rebuildFeed builds the feed again if it has already been built. The feed is
+// first built once the library is imported so an incomplete feed is never
+// served (and cached by readers).
+func rebuildFeed(a *App) {
+	if a.Feed.Load() == nil {
+		return
+	}
+	buildFeed(a)
+}
+
+// rss is the root element of the RSS feed.
+type rss struct {
+	XMLName         xml.Name    `xml:"rss"`
+	Version         string      `xml:"version,attr"`
+	ITunesNamespace string      `xml:"xmlns:itunes,attr"`
+	Channel         *rssChannel `xml:"channel"`
+}
+
+// rssChannel extends the feeds channel with iTunes items.
+type rssChannel struct {
+	*feeds.RssFeed
+	Items []*rssItem `xml:"item"`
+}
+
+// rssItem extends the feeds item with an iTunes duration (in seconds).
+type rssItem struct {
+	*feeds.RssItem
+	Duration string `xml:"itunes:duration,omitempty"`
 }
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/wybiral/tube/pkg/media"
+)
+
+// hlsCacheMemory is the maximum bytes of HLS indexes kept in memory.
+const hlsCacheMemory = 64 << 20
+
+// hlsIndex returns the playing video of an HLS request along with its HLS
+// index, or writes an error response and returns false.
+func (a *App) hlsIndex(w http.ResponseWriter, r *http.Request) (*media.Video, *media.HLSIndex, bool) {
+	m, ok := a.lookup(mux.Vars(r)["id"])
+	if !ok || !m.HLS() {
+		http.NotFound(w, r)
+		return nil, nil, false
+	}
+	if !a.authorize(w, r, m) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, nil, false
+	}
+	idx, err := a.HLS.Get(a.Library.Storage(m.Path), m)
+	if err != nil {
+		log.Println("HLS error:", m.Path, err)
+		http.NotFound(w, r)
+		return nil, nil, false
+	}
+	cache := "public"
+	if m.Visibility == media.Private {
+		cache = "private"
+	}
+	w.Header().Set("Cache-Control", cache+", no-cache")
+	return m, idx, true
+}
+
+// HTTP handler for /v/id/master.m3u8
+func (a *App) hlsMasterHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("/v/%s/master.m3u8", mux.Vars(r)["id"])
+	m, idx, ok := a.hlsIndex(w, r)
+	if !ok {
+		return
+	}
+	attrs := []string{"BANDWIDTH=" + strconv.Itoa(idx.Bandwidth)}
+	if len(m.Type.Codecs) > 0 {
+		codecs := strings.Replace(m.Type.Codecs, " ", "", -1)
+		attrs = append(attrs, `CODECS="`+codecs+`"`)
+	}
+	if m.Width > 0 && m.Height > 0 {
+		attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", m.Width, m.Height))
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprintln(w, "#EXTM3U")
+	fmt.Fprintln(w, "#EXT-X-VERSION:7")
+	fmt.Fprintln(w, "#EXT-X-INDEPENDENT-SEGMENTS")
+	fmt.Fprintln(w, "#EXT-X-STREAM-INF:"+strings.Join(attrs, ","))
+	fmt.Fprintln(w, "index.m3u8")
+}
+
+// HTTP handler for /v/id/index.m3u8
+func (a *App) hlsPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("/v/%s/index.m3u8", mux.Vars(r)["id"])
+	_, idx, ok := a.hlsIndex(w, r)
+	if !ok {
+		return
+	}
+	target := 1
+	for _, d := range idx.Segments {
+		s := int(math.Ceil(d.Seconds()))
+		if s > target {
+			target = s
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprintln(w, "#EXTM3U")
+	fmt.Fprintln(w, "#EXT-X-VERSION:7")
+	fmt.Fprintf(w, "#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintln(w, "#EXT-X-MEDIA-SEQUENCE:0")
+	fmt.Fprintln(w, "#EXT-X-PLAYLIST-TYPE:VOD")
+	fmt.Fprintln(w, "#EXT-X-INDEPENDENT-SEGMENTS")
+	fmt.Fprintln(w, `#EXT-X-MAP:URI="init.m4s"`)
+	for n, d := range idx.Segments {
+		fmt.Fprintf(w, "#EXTINF:%.3f,\n%d.m4s\n", d.Seconds(), n)
+	}
+	fmt.Fprintln(w, "#EXT-X-ENDLIST")
+}
+
+// HTTP handler for /v/id/init.m4s
+func (a *App) hlsInitHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("/v/%s/init.m4s", mux.Vars(r)["id"])
+	_, idx, ok := a.hlsIndex(w, r)
+	if !ok {
+		return
+	}
+	b := idx.Init()
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// HTTP handler for /v/id/n.m4s
+func (a *App) hlsSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	log.Printf("/v/%s/%s.m4s", vars["id"], vars["n"])
+	m, idx, ok := a.hlsIndex(w, r)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(vars["n"])
+	if err != nil || n >= len(idx.Segments) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := a.Library.Storage(m.Path).Open(m.Path)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	b, err := idx.Segment(f, n)
+	if err != nil {
+		log.Println("HLS error:", m.Path, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/wybiral/tube/pkg/media"
+)
+
+// sortOrders are the orders offered for sorting playlists.
+var sortOrders = []string{"date", "title", "size", "duration", "album"}
+
+// page is the data rendered by the index.html template.
+type page struct {
+	Playing  *media.Video
+	Playlist media.Playlist
+	// Album is set when Playlist is limited to the episodes of an album
+	Album string
+	// Query is set when Playlist holds search results
+	Query string
+	// Channel is the library path of Playing, or the one Playlist is limited
+	// to (nil if the path has no name)
+	Channel *channel
+	// Downloads is false when Playing may only be streamed
+	Downloads bool
+	Prev      *media.Video
+	Next      *media.Video
+	// Locked is set when Playing is private and requires a password
+	Locked bool
+	Error  string
+	// Sort is the order of Playlist (empty for episode or relevance order)
+	Sort  string
+	Sorts []string
+	// PageNum is the page of the playlist being shown out of Pages
+	PageNum int
+	Pages   int
+	// Total is the number of videos across all pages
+	Total int
+	// url of the request used to build links
+	url *url.URL
+}
+
+// newPage returns a page for request r playing a video (empty if nil).
+func newPage(r *http.Request, playing *media.Video) *page {
+	if playing == nil {
+		playing = &media.Video{ID: ""}
+	}
+	return &page{
+		Playing:   playing,
+		Downloads: true,
+		Sorts:     sortOrders,
+		PageNum:   1,
+		Pages:     1,
+		url:       r.URL,
+	}
+}
+
+// channel is the section of a named library path.
+type channel struct {
+	Name        string
+	Description string
+	// Link is the URL of the page listing the videos of the path (empty for
+	// the root prefix, whose videos are listed on the home page)
+	Link string
+}
+
+// newChannel returns the channel of library path pc (nil if it has no name).
+func newChannel(pc *PathConfig) *channel {
+	if len(pc.Name) == 0 {
+		return nil
+	}
+	ch := &channel{
+		Name:        pc.Name,
+		Description: pc.Description,
+	}
+	prefix := strings.Trim(pc.Prefix, "/")
+	if len(prefix) > 0 {
+		ch.Link = apiURL("/p/"+prefix, nil)
+	}
+	return ch
+}
+
+// requestSort returns the sort order requested in query q (or def if none).
+func requestSort(q url.Values, def string) string {
+	order := q.Get("sort")
+	if media.IsSortOrder(order) {
+		return order
+	}
+	return def
+}
+
+// library sets the requested sort order (falling back to def) and returns the
+// listed videos of snap presorted in that order.
+func (p *page) library(snap *media.Snapshot, def string) media.Playlist {
+	p.Sort = requestSort(p.url.Query(), def)
+	return snap.Sorted(p.Sort)
+}
+
+// sort sets the requested sort order (falling back to def) and returns pl
+// sorted in that order. Playlists are shared between requests so pl is copied
+// rather than sorted in place.
+func (p *page) sort(pl media.Playlist, def string) media.Playlist {
+	p.Sort = requestSort(p.url.Query(), def)
+	if len(p.Sort) == 0 {
+		return pl
+	}
+	return pl.Sorted(p.Sort)
+}
+
+// setPlaylist sets the page of pl to the one requested, or the one containing
+// the playing video.
+func (p *page) setPlaylist(pl media.Playlist, size int) {
+	if size < 1 {
+		// pagination is disabled
+		size = len(pl) + 1
+	}
+	p.Total = len(pl)
+	p.Pages = pl.Pages(size)
+	n, err := strconv.Atoi(p.url.Query().Get("page"))
+	if err != nil {
+		n = 1
+		for i, v := range pl {
+			if v.ID == p.Playing.ID {
+				n = i/size + 1
+				break
+			}
+		}
+	}
+	if n < 1 {
+		n = 1
+	} else if n > p.Pages {
+		n = p.Pages
+	}
+	p.PageNum = n
+	p.Playlist = pl.Page(n, size)
+}
+
+// Link returns the URL of a video page keeping the requested sort order.
+func (p *page) Link(id string) string {
+	u := &url.URL{Path: "/v/" + id}
+	order := p.url.Query().Get("sort")
+	if len(order) > 0 {
+		u.RawQuery = url.Values{"sort": {order}}.Encode()
+	}
+	return u.String()
+}
+
+// AlbumLink returns the URL of the page listing the episodes of an album.
+func (p *page) AlbumLink(album string) string {
+	return apiURL("/a/"+album, nil)
+}
+
+// SortLink returns the URL of the current page sorted by order.
+func (p *page) SortLink(order string) string {
+	q := p.url.Query()
+	q.Set("sort", order)
+	q.Del("page")
+	u := &url.URL{Path: p.url.Path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// PageLink returns the URL of page n of the current playlist.
+func (p *page) PageLink(n int) string {
+	q := p.url.Query()
+	q.Set("page", strconv.Itoa(n))
+	u := &url.URL{Path: p.url.Path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// PrevPage returns the previous page number (0 if there is none).
+func (p *page) PrevPage() int {
+	if p.PageNum > 1 {
+		return p.PageNum - 1
+	}
+	return 0
+}
+
+// NextPage returns the next page number (0 if there is none).
+func (p *page) NextPage() int {
+	if p.PageNum < p.Pages {
+		return p.PageNum + 1
+	}
+	return 0
+}
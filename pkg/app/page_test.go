@@ -0,0 +1,53 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestNewChannel(t *testing.T) {
+	tests := []struct {
+		name string
+		pc   *PathConfig
+		link string
+	}{
+		{"prefix", &PathConfig{Name: "Travel", Prefix: "travel"}, "/p/travel"},
+		{"slashes", &PathConfig{Name: "Travel", Prefix: "/travel/2019/"}, "/p/travel/2019"},
+		{"escaped", &PathConfig{Name: "Q&A", Prefix: "q?a#1"}, "/p/q%3Fa%231"},
+		// the root prefix has no channel page
+		{"root", &PathConfig{Name: "Home", Prefix: ""}, ""},
+		{"root slash", &PathConfig{Name: "Home", Prefix: "/"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := newChannel(tt.pc)
+			if ch == nil {
+				t.Fatal("got no channel")
+			}
+			if ch.Name != tt.pc.Name || ch.Link != tt.link {
+				t.Errorf("got %q linking to %q, want %q linking to %q", ch.Name, ch.Link, tt.pc.Name, tt.link)
+			}
+		})
+	}
+	if newChannel(&PathConfig{Prefix: "unnamed"}) != nil {
+		t.Error("got channel for path without a name")
+	}
+}
+
+func TestAlbumLink(t *testing.T) {
+	p := &page{}
+	tests := []struct {
+		album string
+		want  string
+	}{
+		{"Travel", "/a/Travel"},
+		{"Road Trip", "/a/Road%20Trip"},
+		{"Q&A?", "/a/Q&A%3F"},
+		{"#1 Hits", "/a/%231%20Hits"},
+	}
+	for _, tt := range tests {
+		got := p.AlbumLink(tt.album)
+		if got != tt.want {
+			t.Errorf("AlbumLink(%q) = %q, want %q", tt.album, got, tt.want)
+		}
+	}
+}
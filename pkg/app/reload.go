@@ -0,0 +1,216 @@
+package app
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	fs "github.com/fsnotify/fsnotify"
+	"github.com/wybiral/tube/pkg/onionkey"
+)
+
+// reloadTimeout is how long to wait after the config file changes before
+// reloading it (editors often write a file in several steps).
+const reloadTimeout = time.Second
+
+// WatchConfig reloads the config from file fp whenever it changes or the
+// process receives SIGHUP.
+func (a *App) WatchConfig(fp string) error {
+	w, err := fs.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// watch the directory since editors may replace the file
+	err = w.Add(filepath.Dir(fp))
+	if err != nil {
+		w.Close()
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		timer := time.NewTimer(reloadTimeout)
+		timer.Stop()
+		for {
+			select {
+			case e := <-w.Events:
+				if filepath.Clean(e.Name) == filepath.Clean(fp) {
+					timer.Reset(reloadTimeout)
+				}
+			case err := <-w.Errors:
+				log.Println(err)
+			case <-hup:
+				a.reload(fp)
+			case <-timer.C:
+				a.reload(fp)
+			}
+		}
+	}()
+	return nil
+}
+
+// reload reads the config from file fp and applies the changes. Invalid
+// configs are ignored. Server, index, secret and thumbnail settings only take
+// effect after a restart.
+func (a *App) reload(fp string) {
+	cfg := DefaultConfig()
+	err := cfg.ReadFile(fp)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		log.Println("Config error:", fp, err)
+		return
+	}
+	old := a.Config()
+	// the listener is already bound (with any random port filled in)
+	cfg.Server = old.Server
+	if cfg.Index != old.Index || cfg.Secret != old.Secret || cfg.Thumbs != old.Thumbs || cfg.ThumbMemory != old.ThumbMemory || cfg.ImportWorkers != old.ImportWorkers {
+		log.Println("Config: index, secret, thumbnail and import settings require a restart")
+		cfg.Index = old.Index
+		cfg.Secret = old.Secret
+		cfg.Thumbs = old.Thumbs
+		cfg.ThumbMemory = old.ThumbMemory
+		cfg.ImportWorkers = old.ImportWorkers
+	}
+	cfg.Library = a.reloadLibrary(old.Library, cfg.Library)
+	if !reflect.DeepEqual(old.Tor, cfg.Tor) {
+		err = a.reloadTor(cfg)
+		if err != nil {
+			log.Println("Tor error:", err)
+		}
+	}
+	a.config.Store(cfg)
+	rebuildFeed(a)
+	log.Println("Reloaded config:", fp)
+}
+
+// reloadLibrary applies changes to library paths and returns the paths now
+// in the library. Paths with changed settings keep their videos while they're
+// imported again in the background.
+func (a *App) reloadLibrary(old, paths []*PathConfig) []*PathConfig {
+	current := make(map[string]*PathConfig, len(old))
+	for _, pc := range old {
+		current[pc.Path] = pc
+	}
+	next := make(map[string]*PathConfig, len(paths))
+	for _, pc := range paths {
+		next[pc.Path] = pc
+	}
+	var kept []*PathConfig
+	for _, pc := range old {
+		_, ok := next[pc.Path]
+		if ok {
+			continue
+		}
+		a.Watcher.Remove(pc.Path)
+		err := a.Library.RemovePath(pc.Path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Println("Removed path:", pc.Path)
+	}
+	for _, pc := range paths {
+		opc, ok := current[pc.Path]
+		if ok {
+			if !samePath(opc, pc) {
+				a.reloadPath(opc, pc)
+			}
+			kept = append(kept, pc)
+			continue
+		}
+		p, err := a.addPath(pc)
+		if err != nil {
+			log.Println("Path error:", pc.Path, err)
+			continue
+		}
+		log.Println("Added path:", pc.Path)
+		kept = append(kept, pc)
+		go func() {
+			err := a.Library.Import(p)
+			if err != nil {
+				log.Println("Import error:", p.Path, err)
+			}
+			a.Library.Publish()
+			saveIndex(a)
+		}()
+	}
+	a.Library.Publish()
+	return kept
+}
+
+// reloadPath applies the changed settings of library path pc (previously
+// opc). A new poll interval only restarts watching the path, other changes
+// import it again in the background and swap in its videos when done.
+func (a *App) reloadPath(opc, pc *PathConfig) {
+	p := newPath(pc)
+	a.Watcher.Remove(pc.Path)
+	err := a.Watcher.Add(p, time.Duration(pc.Poll)*time.Second)
+	if err != nil {
+		log.Println("Watch error:", pc.Path, err)
+	}
+	x, y := *opc, *pc
+	x.Poll, y.Poll = 0, 0
+	if samePath(&x, &y) {
+		log.Println("Updated path:", pc.Path)
+		return
+	}
+	log.Println("Reimporting path:", pc.Path)
+	go func() {
+		err := a.Library.ReimportPath(p)
+		if err != nil {
+			log.Println("Import error:", p.Path, err)
+		}
+		a.Library.Publish()
+		saveIndex(a)
+	}()
+}
+
+// samePath returns true if two library paths have the same settings apart
+// from the ones only read while serving requests (which take effect without
+// importing the path again).
+func samePath(a, b *PathConfig) bool {
+	x, y := *a, *b
+	x.Name, y.Name = "", ""
+	x.Description, y.Description = "", ""
+	x.Downloads, y.Downloads = nil, nil
+	x.Feed, y.Feed = nil, nil
+	return reflect.DeepEqual(&x, &y)
+}
+
+// reloadTor stops the onion service and starts it again with the settings of
+// cfg. The onion key is kept so the address doesn't change.
+func (a *App) reloadTor(cfg *Config) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var key onionkey.Key
+	if a.Tor != nil {
+		key = a.Tor.OnionKey
+		err := a.Tor.stop()
+		if err != nil {
+			log.Println("Tor error:", err)
+		}
+		a.Tor = nil
+	}
+	if !cfg.Tor.Enable {
+		return nil
+	}
+	t, err := newTor(cfg.Tor)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		t.OnionKey = key
+	}
+	err = t.start(cfg.Server)
+	if err != nil {
+		return err
+	}
+	a.Tor = t
+	return nil
+}
@@ -0,0 +1,30 @@
+package app
+
+import (
+	"log"
+	"time"
+)
+
+// scheduler fires when the next scheduled video is published so that the
+// feed can be rebuilt without waiting for a filesystem event.
+type scheduler struct {
+	timer *time.Timer
+	// C receives when a video is published (nil if none are scheduled)
+	C <-chan time.Time
+}
+
+// reset schedules the scheduler for the next release in the Library.
+func (s *scheduler) reset(a *App) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = nil
+	s.C = nil
+	next, ok := a.Library.NextRelease(time.Now())
+	if !ok {
+		return
+	}
+	log.Println("Next release:", next.Format("2006-01-02 03:04 PM"))
+	s.timer = time.NewTimer(time.Until(next))
+	s.C = s.timer.C
+}
@@ -3,6 +3,7 @@ package app
 import (
 	"errors"
 	"fmt"
+	"log"
 	"os"
 
 	"github.com/wybiral/torgo"
@@ -12,6 +13,9 @@ import (
 type tor struct {
 	OnionKey   onionkey.Key
 	Controller *torgo.Controller
+	// ServiceID is the address of the running onion service (without
+	// ".onion")
+	ServiceID string
 }
 
 func newTor(ct *TorConfig) (*tor, error) {
@@ -43,3 +47,39 @@ func newTor(ct *TorConfig) (*tor, error) {
 	}
 	return t, nil
 }
+
+// start registers the onion service forwarding to the server (generating a
+// key first if there is none).
+func (t *tor) start(cs *ServerConfig) error {
+	if t.OnionKey == nil {
+		key, err := onionkey.GenerateKey()
+		if err != nil {
+			return err
+		}
+		t.OnionKey = key
+	}
+	onion, err := t.OnionKey.Onion()
+	if err != nil {
+		return err
+	}
+	onion.Ports[80] = fmt.Sprintf("%s:%d", cs.Host, cs.Port)
+	err = t.Controller.AddOnion(onion)
+	if err != nil {
+		return errors.New("unable to start Tor onion service")
+	}
+	t.ServiceID = onion.ServiceID
+	log.Printf("Onion service: http://%s.onion", onion.ServiceID)
+	return nil
+}
+
+// stop removes the onion service and closes the controller connection.
+func (t *tor) stop() error {
+	if len(t.ServiceID) > 0 {
+		err := t.Controller.DeleteOnion(t.ServiceID)
+		if err != nil {
+			return err
+		}
+		t.ServiceID = ""
+	}
+	return t.Controller.Text.Close()
+}
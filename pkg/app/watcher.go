@@ -1,9 +1,14 @@
 package app
 
 import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	fs "github.com/fsnotify/fsnotify"
+	"github.com/wybiral/tube/pkg/media"
 )
 
 // This is the amount of time to wait after changes before reacting to them.
@@ -19,13 +24,24 @@ const addFlags = fs.Create | fs.Write | fs.Chmod
 // remove, rename, write, and chmod all require a remove event
 const removeFlags = fs.Remove | fs.Rename | fs.Write | fs.Chmod
 
-// watch library paths and update Library with changes.
+// This is how often storages that can't be watched are polled for changes
+// unless configured otherwise.
+const defaultPollInterval = time.Minute
+
+// watch library paths and update Library with changes. Scheduled videos are
+// released here as well by publishing the Library once they're due.
 func startWatcher(a *App) {
 	timer := time.NewTimer(debounceTimeout)
 	addEvents := make(map[string]struct{})
 	removeEvents := make(map[string]struct{})
+	releases := &scheduler{}
+	releases.reset(a)
 	for {
 		select {
+		case <-releases.C:
+			// scheduled videos are now listed
+			a.Library.Publish()
+			releases.reset(a)
 		case e := <-a.Watcher.Events:
 			if e.Op&removeFlags != 0 {
 				removeEvents[e.Name] = struct{}{}
@@ -35,6 +51,15 @@ func startWatcher(a *App) {
 			}
 			// reset timer
 			timer.Reset(debounceTimeout)
+		case e := <-a.Watcher.Polls:
+			// polled changes don't come in bursts so they don't delay the
+			// next batch
+			if e.Op&removeFlags != 0 {
+				removeEvents[e.Name] = struct{}{}
+			}
+			if e.Op&addFlags != 0 {
+				addEvents[e.Name] = struct{}{}
+			}
 		case <-timer.C:
 			eventCount := len(removeEvents) + len(addEvents)
 			// handle remove events first
@@ -48,16 +73,214 @@ func startWatcher(a *App) {
 			// then handle add events
 			if len(addEvents) > 0 {
 				for p := range addEvents {
-					a.Library.Add(p)
+					addFile(a, p)
 				}
 				// clear map
 				addEvents = make(map[string]struct{})
 			}
 			if eventCount > 0 {
-				buildFeed(a)
+				a.Library.Publish()
+				saveIndex(a)
+				releases.reset(a)
 			}
 			// reset timer
 			timer.Reset(debounceTimeout)
 		}
 	}
 }
+
+// Watcher watches library paths for changes. Paths on the local filesystem
+// are watched with fsnotify unless a poll interval is given, other storages
+// are always polled.
+type Watcher struct {
+	mu sync.Mutex
+	fs *fs.Watcher
+	// Events receives changes found by fsnotify
+	Events <-chan fs.Event
+	// Polls receives changes found by polling
+	Polls chan fs.Event
+	// dirs maps the directories watched by fsnotify to their library path
+	dirs map[string]string
+	// stops maps polled library paths to a channel closed to stop polling
+	stops map[string]chan struct{}
+}
+
+// NewWatcher returns a new Watcher without any paths.
+func NewWatcher() (*Watcher, error) {
+	fw, err := fs.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		fs:     fw,
+		Events: fw.Events,
+		Polls:  make(chan fs.Event),
+		dirs:   make(map[string]string),
+		stops:  make(map[string]chan struct{}),
+	}
+	return w, nil
+}
+
+// Add starts watching a library path (polling it every interval if given).
+func (w *Watcher) Add(p *media.Path, interval time.Duration) error {
+	if p.Storage == nil && interval <= 0 {
+		return w.watchDir(p.Path, p.Path)
+	}
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	storage := p.Storage
+	if storage == nil {
+		storage = media.LocalStorage{}
+	}
+	poller := media.NewPoller(storage, p.Path)
+	stop := make(chan struct{})
+	w.mu.Lock()
+	w.stops[p.Path] = stop
+	w.mu.Unlock()
+	go w.poll(poller, interval, stop)
+	return nil
+}
+
+// AddDir starts watching a new directory (and its subdirectories) inside of
+// a library path watched by fsnotify.
+func (w *Watcher) AddDir(dir string) error {
+	w.mu.Lock()
+	var root string
+	for d := filepath.Dir(dir); ; d = filepath.Dir(d) {
+		r, ok := w.dirs[d]
+		if ok {
+			root = r
+			break
+		}
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	w.mu.Unlock()
+	if len(root) == 0 {
+		// not inside of a watched library path
+		return nil
+	}
+	return w.watchDir(dir, root)
+}
+
+// Remove stops watching library path root, including the subdirectories
+// watched inside of it.
+func (w *Watcher) Remove(root string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	stop, ok := w.stops[root]
+	if ok {
+		close(stop)
+		delete(w.stops, root)
+	}
+	for dir, r := range w.dirs {
+		if r == root {
+			// directories that were deleted are already unwatched
+			w.fs.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+}
+
+// watchDir adds a directory and all of its subdirectories to fsnotify as part
+// of library path root. Subdirectories that can't be read or watched are
+// logged and skipped.
+func (w *Watcher) watchDir(dir, root string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			log.Println("Watch error:", err)
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		err = w.fs.Add(p)
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			// keep watching the rest (nested directories may still work)
+			log.Println("Watch error:", p, err)
+			return nil
+		}
+		w.mu.Lock()
+		w.dirs[p] = root
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// poll polls a library path every interval and passes the changes to Polls
+// as fsnotify events until stop is closed. The files are listed right away so
+// the first changes are found after one interval (if that fails the next
+// successful poll is used instead).
+func (w *Watcher) poll(poller *media.Poller, interval time.Duration, stop <-chan struct{}) {
+	_, _, err := poller.Poll()
+	if err != nil {
+		log.Println("Poll error:", poller.Dir, err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		changed, removed, err := poller.Poll()
+		if err != nil {
+			log.Println("Poll error:", poller.Dir, err)
+			continue
+		}
+		var events []fs.Event
+		for _, name := range removed {
+			events = append(events, fs.Event{Name: name, Op: fs.Remove})
+		}
+		for _, name := range changed {
+			events = append(events, fs.Event{Name: name, Op: fs.Write})
+		}
+		for _, e := range events {
+			select {
+			case w.Polls <- e:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// addFile adds a single file to the Library. New directories are watched and
+// everything inside of them is imported since files moved along with a
+// directory don't generate their own events.
+func addFile(a *App, p string) {
+	info, err := a.Library.Storage(p).Stat(p)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		a.Library.Add(p)
+		return
+	}
+	err = a.Watcher.AddDir(p)
+	if err != nil {
+		log.Println(err)
+	}
+	a.Library.ImportDir(p)
+}
+
+// saveIndex writes the Library Index to disk (if enabled).
+func saveIndex(a *App) {
+	idx := a.Library.Index
+	if idx == nil {
+		return
+	}
+	err := idx.Save()
+	if err != nil {
+		log.Println(err)
+	}
+}
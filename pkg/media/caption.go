@@ -0,0 +1,83 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Caption represents a subtitle track stored beside a video as name.lang.vtt
+// or name.lang.srt.
+type Caption struct {
+	Lang string
+	Path string
+}
+
+// srtTiming matches the timing line of an SRT cue.
+var srtTiming = regexp.MustCompile(`^(\d+:\d+:\d+),(\d+) --> (\d+:\d+:\d+),(\d+)`)
+
+// findCaptions returns captions for video path fp from the names of the
+// files in its directory.
+func findCaptions(fp string, names []string) []*Caption {
+	base := strings.TrimSuffix(path.Base(fp), path.Ext(fp)) + "."
+	var captions []*Caption
+	for _, n := range names {
+		ext := strings.ToLower(path.Ext(n))
+		if ext != ".vtt" && ext != ".srt" {
+			continue
+		}
+		// name.vtt has no language so it isn't a caption
+		lang := strings.TrimSuffix(n, path.Ext(n))
+		if !strings.HasPrefix(lang, base) {
+			continue
+		}
+		lang = strings.TrimPrefix(lang, base)
+		if len(lang) == 0 || strings.Contains(lang, ".") {
+			continue
+		}
+		captions = append(captions, &Caption{
+			Lang: lang,
+			Path: path.Join(path.Dir(fp), n),
+		})
+	}
+	return captions
+}
+
+// WriteVTT writes the caption read from s to w as WebVTT, converting from SRT
+// if needed.
+func (c *Caption) WriteVTT(w io.Writer, s Storage) error {
+	b, err := readFile(s, c.Path)
+	if err != nil {
+		return err
+	}
+	// strip UTF-8 byte order mark
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if strings.ToLower(path.Ext(c.Path)) == ".vtt" {
+		_, err = w.Write(b)
+		return err
+	}
+	return srtToVTT(w, bytes.NewReader(b))
+}
+
+// srtToVTT converts SRT subtitles to WebVTT. Cue numbers are kept since they
+// are valid WebVTT cue identifiers, only the header and the decimal separator
+// of timestamps differ.
+func srtToVTT(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n\n")
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		line = srtTiming.ReplaceAllString(line, "$1.$2 --> $3.$4")
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	err := s.Err()
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,141 @@
+package media
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSRTToVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		srt  string
+		vtt  string
+	}{
+		{
+			name: "empty",
+			srt:  "",
+			vtt:  "WEBVTT\n\n",
+		},
+		{
+			name: "zero timestamp",
+			srt:  "1\n00:00:00,000 --> 00:00:01,500\nHello\n",
+			vtt:  "WEBVTT\n\n1\n00:00:00.000 --> 00:00:01.500\nHello\n",
+		},
+		{
+			name: "last millisecond",
+			srt:  "1\n23:59:59,999 --> 99:59:59,999\nBye\n",
+			vtt:  "WEBVTT\n\n1\n23:59:59.999 --> 99:59:59.999\nBye\n",
+		},
+		{
+			name: "more than two hour digits",
+			srt:  "1\n100:00:00,000 --> 100:00:02,000\nLong\n",
+			vtt:  "WEBVTT\n\n1\n100:00:00.000 --> 100:00:02.000\nLong\n",
+		},
+		{
+			name: "crlf",
+			srt:  "1\r\n00:01:02,003 --> 00:01:04,005\r\nOne, two\r\n\r\n2\r\n00:01:05,000 --> 00:01:06,000\r\nThree\r\n",
+			vtt:  "WEBVTT\n\n1\n00:01:02.003 --> 00:01:04.005\nOne, two\n\n2\n00:01:05.000 --> 00:01:06.000\nThree\n",
+		},
+		{
+			name: "cue settings",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000 X1:10 X2:20\nText\n",
+			vtt:  "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000 X1:10 X2:20\nText\n",
+		},
+		{
+			name: "timing in text",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nsee 00:00:01,000 --> 00:00:02,000\n",
+			vtt:  "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nsee 00:00:01,000 --> 00:00:02,000\n",
+		},
+		{
+			name: "missing newline at end",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nText",
+			vtt:  "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nText\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := srtToVTT(&b, bytes.NewReader([]byte(tt.srt)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.vtt {
+				t.Errorf("got %q, want %q", b.String(), tt.vtt)
+			}
+		})
+	}
+}
+
+func TestCaptionWriteVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		vtt  string
+	}{
+		{
+			name: "vtt is copied",
+			file: "v.en.vtt",
+			data: "WEBVTT\n\n00:00.000 --> 00:01.000\nHi\n",
+			vtt:  "WEBVTT\n\n00:00.000 --> 00:01.000\nHi\n",
+		},
+		{
+			name: "srt with byte order mark",
+			file: "v.en.srt",
+			data: "\xef\xbb\xbf1\n00:00:00,000 --> 00:00:01,000\nHi\n",
+			vtt:  "WEBVTT\n\n1\n00:00:00.000 --> 00:00:01.000\nHi\n",
+		},
+		{
+			name: "uppercase extension",
+			file: "v.en.SRT",
+			data: "1\n00:00:00,000 --> 00:00:01,000\nHi\n",
+			vtt:  "WEBVTT\n\n1\n00:00:00.000 --> 00:00:01.000\nHi\n",
+		},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := filepath.Join(dir, tt.file)
+			err := ioutil.WriteFile(fp, []byte(tt.data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Caption{Lang: "en", Path: filepath.ToSlash(fp)}
+			var b bytes.Buffer
+			err = c.WriteVTT(&b, LocalStorage{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.vtt {
+				t.Errorf("got %q, want %q", b.String(), tt.vtt)
+			}
+		})
+	}
+}
+
+func TestFindCaptions(t *testing.T) {
+	names := []string{
+		"clip.mp4",
+		"clip.en.vtt",
+		"clip.pt-BR.srt",
+		"clip.vtt",
+		"clip.en.forced.srt",
+		"clipped.en.vtt",
+		"other.en.vtt",
+	}
+	got := findCaptions("vids/clip.mp4", names)
+	want := []Caption{
+		{Lang: "en", Path: "vids/clip.en.vtt"},
+		{Lang: "pt-BR", Path: "vids/clip.pt-BR.srt"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d captions, want %d", len(got), len(want))
+	}
+	for i, c := range got {
+		if *c != want[i] {
+			t.Errorf("caption %d: got %+v, want %+v", i, *c, want[i])
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package media
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the kind of change described by an Event.
+type EventType int
+
+const (
+	// Added is emitted when a video is added to the library
+	Added EventType = iota
+	// Updated is emitted when a video is parsed again (such as after its
+	// sidecar changed) or a scheduled video is released
+	Updated
+	// Removed is emitted when a video is removed from the library
+	Removed
+)
+
+// String returns the name of the EventType.
+func (t EventType) String() string {
+	switch t {
+	case Added:
+		return "added"
+	case Updated:
+		return "updated"
+	case Removed:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// Event describes a change to a video in the library.
+type Event struct {
+	Type  EventType
+	Video *Video
+	// Old is the previous version of an updated video
+	Old *Video
+}
+
+// Subscription receives the Events of a Library in the order they happened.
+// Events are sent when the Snapshot containing the change is published.
+type Subscription struct {
+	// C receives Events until the Subscription is closed
+	C     <-chan Event
+	c     chan Event
+	mu    sync.Mutex
+	queue []Event
+	wake  chan struct{}
+	done  chan struct{}
+	lib   *Library
+}
+
+// Subscribe returns a new Subscription to changes of the library. Slow
+// subscribers never block the library, Events are queued for them instead.
+func (lib *Library) Subscribe() *Subscription {
+	s := &Subscription{
+		c:    make(chan Event),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		lib:  lib,
+	}
+	s.C = s.c
+	lib.mu.Lock()
+	lib.subs[s] = struct{}{}
+	lib.mu.Unlock()
+	go s.run()
+	return s
+}
+
+// Close stops the Subscription and closes C.
+func (s *Subscription) Close() {
+	s.lib.mu.Lock()
+	_, ok := s.lib.subs[s]
+	delete(s.lib.subs, s)
+	s.lib.mu.Unlock()
+	if ok {
+		close(s.done)
+	}
+}
+
+// send queues events for the subscriber.
+func (s *Subscription) send(events []Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, events...)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued events to C until the Subscription is closed.
+func (s *Subscription) run() {
+	defer close(s.c)
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, e := range queue {
+			select {
+			case s.c <- e:
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// emit records an Event to be sent on the next Publish (lib.mu must be held).
+func (lib *Library) emit(t EventType, v, old *Video) {
+	lib.pending = append(lib.pending, Event{Type: t, Video: v, Old: old})
+}
+
+// release emits an Updated event for videos released since the last Publish
+// (lib.mu must be held).
+func (lib *Library) release(now time.Time) {
+	for _, v := range lib.Videos {
+		if v.Published.After(lib.released) && !v.Published.After(now) {
+			lib.emit(Updated, v, v)
+		}
+	}
+	lib.released = now
+}
+
+// dispatch updates the search index and sends pending events to subscribers
+// (lib.mu must be held).
+func (lib *Library) dispatch() {
+	events := lib.pending
+	lib.pending = nil
+	if len(events) == 0 {
+		return
+	}
+	for _, e := range events {
+		switch e.Type {
+		case Added, Updated:
+			lib.search.add(e.Video)
+		case Removed:
+			lib.search.remove(e.Video.ID)
+		}
+	}
+	for s := range lib.subs {
+		s.send(events)
+	}
+}
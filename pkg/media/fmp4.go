@@ -0,0 +1,469 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// maxTableRead limits the size of sample tables read into memory, which are
+// much larger than other boxes for long videos.
+const maxTableRead = 64 << 20
+
+// maxSampleGap is the largest gap between samples read with a single ReadAt
+// (since interleaved tracks leave gaps between the samples of each track).
+const maxSampleGap = 1 << 20
+
+// maxSampleRead limits the bytes of samples read with a single ReadAt.
+const maxSampleRead = 16 << 20
+
+// Flags of fragmented MP4 samples (sample_depends_on and
+// sample_is_non_sync_sample).
+const (
+	syncSampleFlags    = 0x02000000
+	nonSyncSampleFlags = 0x01010000
+)
+
+// mp4Sample is the location and timing of a sample in an MP4 file.
+type mp4Sample struct {
+	Offset int64
+	// DTS is the decode time in the timescale of the track
+	DTS      uint64
+	Size     uint32
+	Duration uint32
+	// CTO is the offset from decode to composition time
+	CTO  int32
+	Sync bool
+}
+
+// mp4Track is a video or audio track of an MP4 file.
+type mp4Track struct {
+	ID        uint32
+	Handler   string
+	Timescale uint32
+	Samples   []mp4Sample
+	// payloads of the boxes copied into the initialization segment
+	tkhd []byte
+	edts []byte
+	mdhd []byte
+	hdlr []byte
+	stsd []byte
+}
+
+// readMP4Tracks reads the mvhd payload and the video and audio tracks (with
+// their sample tables) from the moov box of an MP4 file of a given size.
+func readMP4Tracks(r io.ReaderAt, size int64) ([]byte, []*mp4Track, error) {
+	mvhd, traks, err := readMoov(r, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tracks []*mp4Track
+	for _, trak := range traks {
+		t, err := readMP4Track(r, trak)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t != nil {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, nil, errors.New("media: no mp4 tracks")
+	}
+	return mvhd, tracks, nil
+}
+
+// readMP4Track reads a track from a trak box (nil if it's not video or
+// audio).
+func readMP4Track(r io.ReaderAt, trak mp4Box) (*mp4Track, error) {
+	tr, err := readTrak(r, trak)
+	if err != nil || tr == nil {
+		return nil, err
+	}
+	t := &mp4Track{Handler: tr.Handler, hdlr: tr.hdlr}
+	tkhd, ok := findBox(tr.boxes, "tkhd")
+	if !ok {
+		return nil, errors.New("media: missing mp4 box tkhd")
+	}
+	t.tkhd, err = readBox(r, tkhd)
+	if err != nil {
+		return nil, err
+	}
+	// track_ID follows the creation and modification times
+	if len(t.tkhd) >= 24 && t.tkhd[0] == 1 {
+		t.ID = binary.BigEndian.Uint32(t.tkhd[20:24])
+	} else if len(t.tkhd) >= 16 {
+		t.ID = binary.BigEndian.Uint32(t.tkhd[12:16])
+	} else {
+		return nil, errors.New("media: invalid mp4 box tkhd")
+	}
+	edts, ok := findBox(tr.boxes, "edts")
+	if ok {
+		t.edts, err = readBox(r, edts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mdhd, ok := findBox(tr.mdia, "mdhd")
+	if !ok {
+		return nil, errors.New("media: missing mp4 box mdhd")
+	}
+	t.mdhd, err = readBox(r, mdhd)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.mdhd) >= 24 && t.mdhd[0] == 1 {
+		t.Timescale = binary.BigEndian.Uint32(t.mdhd[20:24])
+	} else if len(t.mdhd) >= 16 {
+		t.Timescale = binary.BigEndian.Uint32(t.mdhd[12:16])
+	}
+	if t.Timescale == 0 {
+		return nil, errors.New("media: invalid mp4 box mdhd")
+	}
+	stsd, ok := findBox(tr.stbl, "stsd")
+	if !ok {
+		return nil, errors.New("media: missing mp4 box stsd")
+	}
+	t.stsd, err = readBox(r, stsd)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string][]byte)
+	for _, typ := range []string{"stts", "ctts", "stss", "stsz", "stsc", "stco", "co64"} {
+		b, ok := findBox(tr.stbl, typ)
+		if !ok {
+			continue
+		}
+		tables[typ], err = readTable(r, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.Samples, err = parseSampleTables(tables)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readTable reads the payload of a sample table box into memory.
+func readTable(r io.ReaderAt, b mp4Box) ([]byte, error) {
+	if b.Size > maxTableRead {
+		return nil, errors.New("media: mp4 box too large " + b.Type)
+	}
+	buf := make([]byte, b.Size)
+	_, err := r.ReadAt(buf, b.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// tableEntries returns the entries of a sample table payload which have a
+// given size and follow version/flags and the entry count.
+func tableEntries(b []byte, size int) ([]byte, int, error) {
+	if len(b) < 8 {
+		return nil, 0, errors.New("media: invalid mp4 sample table")
+	}
+	n := int(binary.BigEndian.Uint32(b[4:8]))
+	if n < 0 || n > (len(b)-8)/size {
+		return nil, 0, errors.New("media: invalid mp4 sample table")
+	}
+	return b[8:], n, nil
+}
+
+// parseSampleTables returns the samples described by the payloads of the
+// sample table boxes of a track.
+func parseSampleTables(tables map[string][]byte) ([]mp4Sample, error) {
+	stsz, ok := tables["stsz"]
+	if !ok || len(stsz) < 12 {
+		return nil, errors.New("media: missing mp4 box stsz")
+	}
+	uniform := binary.BigEndian.Uint32(stsz[4:8])
+	n := int(binary.BigEndian.Uint32(stsz[8:12]))
+	if n == 0 {
+		// fragmented files keep their samples in moof boxes instead
+		return nil, errors.New("media: no mp4 samples")
+	}
+	if uniform == 0 && n > (len(stsz)-12)/4 {
+		return nil, errors.New("media: invalid mp4 box stsz")
+	}
+	if n > maxTableRead/4 {
+		return nil, errors.New("media: too many mp4 samples")
+	}
+	samples := make([]mp4Sample, n)
+	for i := range samples {
+		samples[i].Size = uniform
+		if uniform == 0 {
+			samples[i].Size = binary.BigEndian.Uint32(stsz[12+i*4:])
+		}
+	}
+	// decode times
+	entries, count, err := tableEntries(tables["stts"], 8)
+	if err != nil {
+		return nil, err
+	}
+	var dts uint64
+	i := 0
+	for e := 0; e < count && i < n; e++ {
+		c := int(binary.BigEndian.Uint32(entries[e*8:]))
+		delta := binary.BigEndian.Uint32(entries[e*8+4:])
+		for ; c > 0 && i < n; c-- {
+			samples[i].DTS = dts
+			samples[i].Duration = delta
+			dts += uint64(delta)
+			i++
+		}
+	}
+	if i < n {
+		return nil, errors.New("media: invalid mp4 box stts")
+	}
+	// composition offsets are optional
+	if ctts, ok := tables["ctts"]; ok {
+		entries, count, err := tableEntries(ctts, 8)
+		if err != nil {
+			return nil, err
+		}
+		i := 0
+		for e := 0; e < count && i < n; e++ {
+			c := int(binary.BigEndian.Uint32(entries[e*8:]))
+			offset := int32(binary.BigEndian.Uint32(entries[e*8+4:]))
+			for ; c > 0 && i < n; c-- {
+				samples[i].CTO = offset
+				i++
+			}
+		}
+	}
+	// every sample is a sync sample when stss is missing
+	if stss, ok := tables["stss"]; ok {
+		entries, count, err := tableEntries(stss, 4)
+		if err != nil {
+			return nil, err
+		}
+		for e := 0; e < count; e++ {
+			s := int(binary.BigEndian.Uint32(entries[e*4:]))
+			if s >= 1 && s <= n {
+				samples[s-1].Sync = true
+			}
+		}
+	} else {
+		for i := range samples {
+			samples[i].Sync = true
+		}
+	}
+	// chunk offsets
+	var offsets []int64
+	if stco, ok := tables["stco"]; ok {
+		entries, count, err := tableEntries(stco, 4)
+		if err != nil {
+			return nil, err
+		}
+		offsets = make([]int64, count)
+		for c := range offsets {
+			offsets[c] = int64(binary.BigEndian.Uint32(entries[c*4:]))
+		}
+	} else if co64, ok := tables["co64"]; ok {
+		entries, count, err := tableEntries(co64, 8)
+		if err != nil {
+			return nil, err
+		}
+		offsets = make([]int64, count)
+		for c := range offsets {
+			offsets[c] = int64(binary.BigEndian.Uint64(entries[c*8:]))
+		}
+	} else {
+		return nil, errors.New("media: missing mp4 box stco")
+	}
+	// samples per chunk apply from their first chunk until the next entry
+	entries, count, err = tableEntries(tables["stsc"], 12)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errors.New("media: invalid mp4 box stsc")
+	}
+	i = 0
+	e := 0
+	for c, off := range offsets {
+		for e+1 < count && int(binary.BigEndian.Uint32(entries[(e+1)*12:])) <= c+1 {
+			e++
+		}
+		spc := int(binary.BigEndian.Uint32(entries[e*12+4:]))
+		for ; spc > 0 && i < n; spc-- {
+			samples[i].Offset = off
+			off += int64(samples[i].Size)
+			i++
+		}
+	}
+	if i < n {
+		return nil, errors.New("media: invalid mp4 box stsc")
+	}
+	return samples, nil
+}
+
+// makeBox returns an MP4 box of type typ containing the concatenated data.
+func makeBox(typ string, data ...[]byte) []byte {
+	size := 8
+	for _, d := range data {
+		size += len(d)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b[0:4], uint32(size))
+	copy(b[4:8], typ)
+	for _, d := range data {
+		b = append(b, d...)
+	}
+	return b
+}
+
+// be32 returns v as 4 big endian bytes.
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// be64 returns v as 8 big endian bytes.
+func be64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// makeInit returns a fragmented MP4 initialization segment for tracks. The
+// sample tables of the tracks are left empty since their samples are stored
+// in the fragments of each segment instead.
+func makeInit(mvhd []byte, tracks []*mp4Track) []byte {
+	ftyp := makeBox("ftyp", []byte("iso6"), be32(0), []byte("iso6mp41isom"))
+	moov := [][]byte{makeBox("mvhd", mvhd)}
+	var trex [][]byte
+	for _, t := range tracks {
+		var mhd []byte
+		if t.Handler == "vide" {
+			mhd = makeBox("vmhd", be32(1), make([]byte, 8))
+		} else {
+			mhd = makeBox("smhd", make([]byte, 8))
+		}
+		// data is in the same file (self-contained flag)
+		dinf := makeBox("dinf", makeBox("dref", be32(0), be32(1), makeBox("url ", be32(1))))
+		stbl := makeBox("stbl",
+			makeBox("stsd", t.stsd),
+			makeBox("stts", be32(0), be32(0)),
+			makeBox("stsc", be32(0), be32(0)),
+			makeBox("stsz", be32(0), be32(0), be32(0)),
+			makeBox("stco", be32(0), be32(0)),
+		)
+		mdia := makeBox("mdia",
+			makeBox("mdhd", t.mdhd),
+			makeBox("hdlr", t.hdlr),
+			makeBox("minf", mhd, dinf, stbl),
+		)
+		trak := [][]byte{makeBox("tkhd", t.tkhd)}
+		if t.edts != nil {
+			trak = append(trak, makeBox("edts", t.edts))
+		}
+		trak = append(trak, mdia)
+		moov = append(moov, makeBox("trak", trak...))
+		// default sample description index 1, other defaults are in trun
+		trex = append(trex, makeBox("trex", be32(0), be32(t.ID), be32(1), be32(0), be32(0), be32(0)))
+	}
+	moov = append(moov, makeBox("mvex", trex...))
+	return append(ftyp, makeBox("moov", moov...)...)
+}
+
+// makeFragment returns a fragmented MP4 segment (moof and mdat) with sequence
+// number seq holding the samples of each track and their data.
+func makeFragment(seq uint32, tracks []*mp4Track, samples [][]mp4Sample, data []byte) []byte {
+	moof := makeMoof(seq, tracks, samples, 0)
+	// sample data starts after moof and the mdat header
+	moof = makeMoof(seq, tracks, samples, uint32(len(moof)+8))
+	b := make([]byte, 0, len(moof)+8+len(data))
+	b = append(b, moof...)
+	b = append(b, be32(uint32(8+len(data)))...)
+	b = append(b, "mdat"...)
+	return append(b, data...)
+}
+
+// makeMoof returns a moof box for samples whose data starts at offset
+// dataOffset from the start of the box.
+func makeMoof(seq uint32, tracks []*mp4Track, samples [][]mp4Sample, dataOffset uint32) []byte {
+	moof := [][]byte{makeBox("mfhd", be32(0), be32(seq))}
+	for i, t := range tracks {
+		ss := samples[i]
+		if len(ss) == 0 {
+			continue
+		}
+		// version 1 for signed composition offsets with flags for data
+		// offset, duration, size, flags and composition offset per sample
+		trun := make([]byte, 12, 12+16*len(ss))
+		binary.BigEndian.PutUint32(trun[0:4], 1<<24|0x000f01)
+		binary.BigEndian.PutUint32(trun[4:8], uint32(len(ss)))
+		binary.BigEndian.PutUint32(trun[8:12], dataOffset)
+		for _, s := range ss {
+			flags := uint32(nonSyncSampleFlags)
+			if s.Sync {
+				flags = syncSampleFlags
+			}
+			trun = append(trun, be32(s.Duration)...)
+			trun = append(trun, be32(s.Size)...)
+			trun = append(trun, be32(flags)...)
+			trun = append(trun, be32(uint32(s.CTO))...)
+			dataOffset += s.Size
+		}
+		moof = append(moof, makeBox("traf",
+			// default-base-is-moof
+			makeBox("tfhd", be32(0x020000), be32(t.ID)),
+			makeBox("tfdt", be32(1<<24), be64(ss[0].DTS)),
+			makeBox("trun", trun),
+		))
+	}
+	return makeBox("moof", moof...)
+}
+
+// readSamples reads the data of samples from r into a single buffer in
+// order. Nearby samples are read together to avoid a request per sample on
+// remote storage.
+func readSamples(r io.ReaderAt, samples []mp4Sample) ([]byte, error) {
+	type piece struct {
+		offset int64
+		size   int64
+		dst    int64
+	}
+	pieces := make([]piece, len(samples))
+	var total int64
+	for i, s := range samples {
+		pieces[i] = piece{s.Offset, int64(s.Size), total}
+		total += int64(s.Size)
+	}
+	sort.Slice(pieces, func(i, j int) bool {
+		return pieces[i].offset < pieces[j].offset
+	})
+	data := make([]byte, total)
+	for start := 0; start < len(pieces); {
+		// extend the read while the next sample is close enough
+		end := start + 1
+		readEnd := pieces[start].offset + pieces[start].size
+		for end < len(pieces) {
+			p := pieces[end]
+			if p.offset-readEnd > maxSampleGap || p.offset+p.size-pieces[start].offset > maxSampleRead {
+				break
+			}
+			if p.offset+p.size > readEnd {
+				readEnd = p.offset + p.size
+			}
+			end++
+		}
+		buf := make([]byte, readEnd-pieces[start].offset)
+		_, err := r.ReadAt(buf, pieces[start].offset)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pieces[start:end] {
+			off := p.offset - pieces[start].offset
+			copy(data[p.dst:p.dst+p.size], buf[off:off+p.size])
+		}
+		start = end
+	}
+	return data, nil
+}
@@ -0,0 +1,291 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// testTraf is a track fragment read back from a fragmented MP4 segment.
+type testTraf struct {
+	ID         uint32
+	DTS        uint64
+	DataOffset uint32
+	Samples    []mp4Sample
+}
+
+// parseFragment reads the sequence number and track fragments of a segment
+// made by makeFragment along with the payload of its mdat box.
+func parseFragment(t *testing.T, b []byte) (uint32, []testTraf, []byte) {
+	r := bytes.NewReader(b)
+	top, err := readBoxes(r, 0, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Type != "moof" || top[1].Type != "mdat" {
+		t.Fatalf("got boxes %v, want moof and mdat", top)
+	}
+	moof, err := readBoxes(r, top[0].Offset, top[0].Offset+top[0].Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seq uint32
+	var trafs []testTraf
+	for _, box := range moof {
+		switch box.Type {
+		case "mfhd":
+			seq = binary.BigEndian.Uint32(b[box.Offset+4:])
+		case "traf":
+			children, err := readBoxes(r, box.Offset, box.Offset+box.Size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var traf testTraf
+			for _, c := range children {
+				p := b[c.Offset : c.Offset+c.Size]
+				switch c.Type {
+				case "tfhd":
+					traf.ID = binary.BigEndian.Uint32(p[4:])
+				case "tfdt":
+					traf.DTS = binary.BigEndian.Uint64(p[4:])
+				case "trun":
+					n := int(binary.BigEndian.Uint32(p[4:]))
+					traf.DataOffset = binary.BigEndian.Uint32(p[8:])
+					for i := 0; i < n; i++ {
+						e := p[12+i*16:]
+						traf.Samples = append(traf.Samples, mp4Sample{
+							Duration: binary.BigEndian.Uint32(e[0:]),
+							Size:     binary.BigEndian.Uint32(e[4:]),
+							Sync:     binary.BigEndian.Uint32(e[8:]) == syncSampleFlags,
+							CTO:      int32(binary.BigEndian.Uint32(e[12:])),
+						})
+					}
+				}
+			}
+			trafs = append(trafs, traf)
+		}
+	}
+	return seq, trafs, b[top[1].Offset : top[1].Offset+top[1].Size]
+}
+
+func TestParseSampleTables(t *testing.T) {
+	tests := []struct {
+		name   string
+		tables map[string][]byte
+		want   []mp4Sample
+	}{
+		{
+			name: "uniform size without stss",
+			tables: map[string][]byte{
+				"stsz": fullBox(10, 3),
+				"stts": fullBox(1, 3, 100),
+				"stsc": fullBox(1, 1, 3, 1),
+				"stco": fullBox(1, 1000),
+			},
+			want: []mp4Sample{
+				{Offset: 1000, DTS: 0, Size: 10, Duration: 100, Sync: true},
+				{Offset: 1010, DTS: 100, Size: 10, Duration: 100, Sync: true},
+				{Offset: 1020, DTS: 200, Size: 10, Duration: 100, Sync: true},
+			},
+		},
+		{
+			name: "stts and stsc entries",
+			tables: map[string][]byte{
+				"stsz": fullBox(0, 5, 1, 2, 3, 4, 5),
+				"stts": fullBox(2, 2, 10, 3, 20),
+				"stss": fullBox(2, 1, 4),
+				"stsc": fullBox(2, 1, 2, 1, 2, 1, 1),
+				"stco": fullBox(4, 100, 200, 300, 400),
+			},
+			want: []mp4Sample{
+				{Offset: 100, DTS: 0, Size: 1, Duration: 10, Sync: true},
+				{Offset: 101, DTS: 10, Size: 2, Duration: 10},
+				{Offset: 200, DTS: 20, Size: 3, Duration: 20},
+				{Offset: 300, DTS: 40, Size: 4, Duration: 20, Sync: true},
+				{Offset: 400, DTS: 60, Size: 5, Duration: 20},
+			},
+		},
+		{
+			name: "composition offsets and 64-bit chunk offsets",
+			tables: map[string][]byte{
+				"stsz": fullBox(0, 3, 7, 8, 9),
+				"stts": fullBox(1, 3, 512),
+				"ctts": fullBox(2, 1, 1024, 2, 0xfffffe00),
+				"stss": fullBox(1, 1),
+				"stsc": fullBox(1, 1, 3, 1),
+				"co64": append(fullBox(1), be64(1<<33)...),
+			},
+			want: []mp4Sample{
+				{Offset: 1 << 33, DTS: 0, Size: 7, Duration: 512, CTO: 1024, Sync: true},
+				{Offset: 1<<33 + 7, DTS: 512, Size: 8, Duration: 512, CTO: -512},
+				{Offset: 1<<33 + 15, DTS: 1024, Size: 9, Duration: 512, CTO: -512},
+			},
+		},
+		{
+			name: "stss out of range",
+			tables: map[string][]byte{
+				"stsz": fullBox(4, 2),
+				"stts": fullBox(1, 2, 1),
+				"stss": fullBox(3, 0, 2, 3),
+				"stsc": fullBox(1, 1, 1, 1),
+				"stco": fullBox(2, 8, 16),
+			},
+			want: []mp4Sample{
+				{Offset: 8, DTS: 0, Size: 4, Duration: 1},
+				{Offset: 16, DTS: 1, Size: 4, Duration: 1, Sync: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSampleTables(tt.tables)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSampleTablesErrors(t *testing.T) {
+	valid := map[string][]byte{
+		"stsz": fullBox(10, 3),
+		"stts": fullBox(1, 3, 100),
+		"stsc": fullBox(1, 1, 3, 1),
+		"stco": fullBox(1, 1000),
+	}
+	tests := []struct {
+		name  string
+		typ   string
+		table []byte
+	}{
+		{"missing stsz", "stsz", nil},
+		{"no samples", "stsz", fullBox(0, 0)},
+		{"short stsz", "stsz", fullBox(0, 3, 1, 2)},
+		{"missing stts", "stts", nil},
+		{"short stts", "stts", fullBox(1, 2, 100)},
+		{"truncated stts", "stts", fullBox(2, 3, 100)},
+		{"empty stsc", "stsc", fullBox(0)},
+		{"short stsc", "stsc", fullBox(1, 1, 2, 1)},
+		{"missing stco", "stco", nil},
+		{"truncated stco", "stco", fullBox(2, 1000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables := make(map[string][]byte)
+			for typ, b := range valid {
+				tables[typ] = b
+			}
+			delete(tables, tt.typ)
+			if tt.table != nil {
+				tables[tt.typ] = tt.table
+			}
+			_, err := parseSampleTables(tables)
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+// countingReader counts the calls to ReadAt.
+type countingReader struct {
+	*bytes.Reader
+	reads int
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestReadSamples(t *testing.T) {
+	file := make([]byte, 3*maxSampleGap)
+	for i := range file {
+		file[i] = byte(i % 251)
+	}
+	tests := []struct {
+		name    string
+		samples []mp4Sample
+		reads   int
+	}{
+		{"none", nil, 0},
+		{"adjacent", []mp4Sample{{Offset: 0, Size: 10}, {Offset: 10, Size: 5}}, 1},
+		{"out of order", []mp4Sample{{Offset: 100, Size: 10}, {Offset: 0, Size: 10}}, 1},
+		{"small gap", []mp4Sample{{Offset: 0, Size: 10}, {Offset: maxSampleGap, Size: 10}}, 1},
+		{"large gap", []mp4Sample{{Offset: 0, Size: 10}, {Offset: maxSampleGap + 11, Size: 10}}, 2},
+		{"overlapping", []mp4Sample{{Offset: 0, Size: 20}, {Offset: 5, Size: 5}, {Offset: 30, Size: 1}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &countingReader{Reader: bytes.NewReader(file)}
+			got, err := readSamples(r, tt.samples)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []byte
+			for _, s := range tt.samples {
+				want = append(want, file[s.Offset:s.Offset+int64(s.Size)]...)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %d bytes of data that don't match", len(got))
+			}
+			if r.reads != tt.reads {
+				t.Errorf("got %d reads, want %d", r.reads, tt.reads)
+			}
+		})
+	}
+}
+
+func TestMakeFragment(t *testing.T) {
+	tracks := []*mp4Track{{ID: 1}, {ID: 2}, {ID: 3}}
+	samples := [][]mp4Sample{
+		{
+			{DTS: 1024, Size: 3, Duration: 512, CTO: 1024, Sync: true},
+			{DTS: 1536, Size: 2, Duration: 512, CTO: -512},
+		},
+		// tracks without samples are left out
+		nil,
+		{{DTS: 48000, Size: 4, Duration: 1024, Sync: true}},
+	}
+	data := []byte("aaabbcccc")
+	seq, trafs, mdat := parseFragment(t, makeFragment(7, tracks, samples, data))
+	if seq != 7 {
+		t.Errorf("got sequence number %d, want 7", seq)
+	}
+	if !bytes.Equal(mdat, data) {
+		t.Errorf("got mdat %q, want %q", mdat, data)
+	}
+	if len(trafs) != 2 {
+		t.Fatalf("got %d track fragments, want 2", len(trafs))
+	}
+	b := makeFragment(7, tracks, samples, data)
+	mdatStart := len(b) - len(data)
+	want := []struct {
+		id     uint32
+		dts    uint64
+		offset int
+		n      int
+	}{
+		{1, 1024, mdatStart, 0},
+		{3, 48000, mdatStart + 5, 2},
+	}
+	for i, w := range want {
+		traf := trafs[i]
+		if traf.ID != w.id || traf.DTS != w.dts || int(traf.DataOffset) != w.offset {
+			t.Errorf("traf %d: got id %d, dts %d, offset %d, want %d, %d, %d",
+				i, traf.ID, traf.DTS, traf.DataOffset, w.id, w.dts, w.offset)
+		}
+		ss := samples[w.n]
+		for j := range ss {
+			s := ss[j]
+			s.DTS = 0
+			if traf.Samples[j] != s {
+				t.Errorf("traf %d sample %d: got %+v, want %+v", i, j, traf.Samples[j], s)
+			}
+		}
+	}
+}
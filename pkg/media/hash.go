@@ -0,0 +1,39 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+)
+
+// hashSampleSize is the number of bytes read from both the start and end of
+// a file when hashing it.
+const hashSampleSize = 1 << 20
+
+// contentHash returns a hash identifying the contents of a file. Only the
+// size and samples from the start and end are hashed so that large videos
+// can be hashed quickly.
+func contentHash(r io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, size)
+	n := int64(hashSampleSize)
+	if size < 2*n {
+		n = size
+	}
+	_, err := io.Copy(h, io.NewSectionReader(r, 0, n))
+	if err != nil {
+		return "", err
+	}
+	if size > n {
+		start := size - hashSampleSize
+		if start < n {
+			start = n
+		}
+		_, err = io.Copy(h, io.NewSectionReader(r, start, size-start))
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
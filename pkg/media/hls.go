@@ -0,0 +1,240 @@
+package media
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// hlsSegmentDuration is the target duration of HLS segments. Segments start
+// at the first keyframe after it so they're usually a little longer.
+const hlsSegmentDuration = 6 * time.Second
+
+// mp4SampleSize is the size of mp4Sample in memory.
+const mp4SampleSize = 32
+
+// HLSIndex splits an MP4 video into segments starting at keyframes so it can
+// be streamed with HLS as fragmented MP4, remuxed from the original file.
+type HLSIndex struct {
+	// Segments holds the duration of each segment
+	Segments []time.Duration
+	// Bandwidth is the peak bitrate of the segments (in bits per second)
+	Bandwidth int
+	tracks    []*mp4Track
+	// starts holds the first sample of each segment for each track followed
+	// by the number of samples
+	starts [][]int
+	init   []byte
+}
+
+// NewHLSIndex reads the sample tables of an MP4 (or QuickTime) file of a
+// given size and splits it into segments.
+func NewHLSIndex(r io.ReaderAt, size int64) (*HLSIndex, error) {
+	mvhd, tracks, err := readMP4Tracks(r, size)
+	if err != nil {
+		return nil, err
+	}
+	idx := &HLSIndex{
+		tracks: tracks,
+		starts: make([][]int, len(tracks)),
+		init:   makeInit(mvhd, tracks),
+	}
+	// segments are split at the keyframes of the first video track
+	ref := tracks[0]
+	for _, t := range tracks {
+		if t.Handler == "vide" {
+			ref = t
+			break
+		}
+	}
+	target := uint64(hlsSegmentDuration.Seconds() * float64(ref.Timescale))
+	bounds := []int{0}
+	start := ref.Samples[0].DTS
+	for i, s := range ref.Samples {
+		if i > 0 && s.Sync && s.DTS-start >= target {
+			bounds = append(bounds, i)
+			start = s.DTS
+		}
+	}
+	last := ref.Samples[len(ref.Samples)-1]
+	end := last.DTS + uint64(last.Duration)
+	for k, b := range bounds {
+		next := end
+		if k+1 < len(bounds) {
+			next = ref.Samples[bounds[k+1]].DTS
+		}
+		d := mp4Duration(next-ref.Samples[b].DTS, ref.Timescale)
+		idx.Segments = append(idx.Segments, d)
+	}
+	// other tracks are split at the same times
+	for i, t := range tracks {
+		starts := make([]int, 0, len(bounds)+1)
+		j := 0
+		for _, b := range bounds {
+			dts := ref.Samples[b].DTS
+			for j < len(t.Samples) && t.Samples[j].DTS*uint64(ref.Timescale) < dts*uint64(t.Timescale) {
+				j++
+			}
+			starts = append(starts, j)
+		}
+		// the first segment starts with the first sample of every track
+		starts[0] = 0
+		idx.starts[i] = append(starts, len(t.Samples))
+	}
+	for n, d := range idx.Segments {
+		if d <= 0 {
+			continue
+		}
+		var bytes int64
+		for i, t := range tracks {
+			for _, s := range t.Samples[idx.starts[i][n]:idx.starts[i][n+1]] {
+				bytes += int64(s.Size)
+			}
+		}
+		bw := int(float64(bytes*8) / d.Seconds())
+		if bw > idx.Bandwidth {
+			idx.Bandwidth = bw
+		}
+	}
+	return idx, nil
+}
+
+// mp4Duration converts a duration in timescale units to a time.Duration.
+func mp4Duration(d uint64, timescale uint32) time.Duration {
+	return time.Duration(float64(d) / float64(timescale) * float64(time.Second))
+}
+
+// Init returns the initialization segment shared by every segment.
+func (idx *HLSIndex) Init() []byte {
+	return idx.init
+}
+
+// Segment returns segment n remuxed from the samples of file r.
+func (idx *HLSIndex) Segment(r io.ReaderAt, n int) ([]byte, error) {
+	if n < 0 || n >= len(idx.Segments) {
+		return nil, errors.New("media: invalid hls segment")
+	}
+	samples := make([][]mp4Sample, len(idx.tracks))
+	var all []mp4Sample
+	for i, t := range idx.tracks {
+		samples[i] = t.Samples[idx.starts[i][n]:idx.starts[i][n+1]]
+		all = append(all, samples[i]...)
+	}
+	data, err := readSamples(r, all)
+	if err != nil {
+		return nil, err
+	}
+	// sequence numbers start at 1
+	return makeFragment(uint32(n+1), idx.tracks, samples, data), nil
+}
+
+// size returns the approximate bytes of memory used by the index.
+func (idx *HLSIndex) size() int {
+	n := len(idx.init)
+	for i, t := range idx.tracks {
+		n += len(t.Samples)*mp4SampleSize + len(idx.starts[i])*8
+	}
+	return n
+}
+
+// HLSCache builds the HLS indexes of videos on demand and keeps the most
+// recently used in memory (up to a limit) so segments can be served without
+// reading the sample tables again.
+type HLSCache struct {
+	mu sync.Mutex
+	// MaxMemory is the maximum bytes of indexes kept in memory
+	MaxMemory int
+	size      int
+	lru       *list.List
+	items     map[string]*list.Element
+}
+
+// hlsEntry is an index kept in memory by HLSCache. Requests for an index
+// that's still being built wait for ready to be closed.
+type hlsEntry struct {
+	key   string
+	ready chan struct{}
+	idx   *HLSIndex
+	err   error
+	size  int
+}
+
+// NewHLSCache returns an HLSCache keeping up to maxMemory bytes of indexes
+// in memory.
+func NewHLSCache(maxMemory int) *HLSCache {
+	return &HLSCache{
+		MaxMemory: maxMemory,
+		lru:       list.New(),
+		items:     make(map[string]*list.Element),
+	}
+}
+
+// Get returns the HLS index of v (read from s), building it if it isn't
+// cached yet.
+func (c *HLSCache) Get(s Storage, v *Video) (*HLSIndex, error) {
+	// the hash changes with the contents of the file
+	key := v.Path + "\x00" + v.Hash
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if ok {
+		c.lru.MoveToFront(el)
+		e := el.Value.(*hlsEntry)
+		c.mu.Unlock()
+		<-e.ready
+		return e.idx, e.err
+	}
+	e := &hlsEntry{key: key, ready: make(chan struct{})}
+	c.items[key] = c.lru.PushFront(e)
+	c.mu.Unlock()
+	e.idx, e.err = loadHLSIndex(s, v)
+	close(e.ready)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok = c.items[key]
+	if !ok || el.Value != e {
+		// evicted while building
+		return e.idx, e.err
+	}
+	if e.err != nil {
+		// errors aren't cached so the file is read again next time
+		c.lru.Remove(el)
+		delete(c.items, key)
+		return e.idx, e.err
+	}
+	e.size = e.idx.size()
+	c.size += e.size
+	for c.size > c.MaxMemory && c.lru.Len() > 1 {
+		back := c.lru.Back()
+		be := back.Value.(*hlsEntry)
+		c.lru.Remove(back)
+		delete(c.items, be.key)
+		c.size -= be.size
+	}
+	return e.idx, e.err
+}
+
+// loadHLSIndex builds the HLS index of v from its file.
+func loadHLSIndex(s Storage, v *Video) (*HLSIndex, error) {
+	f, err := s.Open(v.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return NewHLSIndex(f, info.Size())
+}
+
+// HLS returns true if the video can be streamed with HLS (remuxed into
+// fragmented MP4).
+func (v *Video) HLS() bool {
+	switch v.Type.MIMEType {
+	case "video/mp4", "video/quicktime":
+		return v.Playable && len(v.VideoCodec) > 0
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package media
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewHLSIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		tracks []testTrack
+		// segment durations in milliseconds
+		segments []int
+		starts   [][]int
+	}{
+		{
+			name:     "keyframe every 1.5s",
+			tracks:   []testTrack{testVideo(300, 45), testAudio(470)},
+			segments: []int{6000, 4000},
+			starts:   [][]int{{0, 180, 300}, {0, 282, 470}},
+		},
+		{
+			name:     "keyframe every 4s",
+			tracks:   []testTrack{testVideo(300, 120), testAudio(470)},
+			segments: []int{8000, 2000},
+			starts:   [][]int{{0, 240, 300}, {0, 375, 470}},
+		},
+		{
+			name:     "keyframe every 7s",
+			tracks:   []testTrack{testVideo(600, 210)},
+			segments: []int{7000, 7000, 6000},
+			starts:   [][]int{{0, 210, 420, 600}},
+		},
+		{
+			name:     "every frame is a keyframe",
+			tracks:   []testTrack{testVideo(400, 0)},
+			segments: []int{6000, 6000, 1333},
+			starts:   [][]int{{0, 180, 360, 400}},
+		},
+		{
+			name:     "single keyframe",
+			tracks:   []testTrack{testVideo(300, 300), testAudio(470)},
+			segments: []int{10000},
+			starts:   [][]int{{0, 300}, {0, 470}},
+		},
+		{
+			name:     "shorter than a segment",
+			tracks:   []testTrack{testVideo(60, 30)},
+			segments: []int{2000},
+			starts:   [][]int{{0, 60}},
+		},
+		{
+			name:     "audio after video",
+			tracks:   []testTrack{testAudio(470), testVideo(300, 45)},
+			segments: []int{6000, 4000},
+			starts:   [][]int{{0, 282, 470}, {0, 180, 300}},
+		},
+		{
+			name:     "audio only",
+			tracks:   []testTrack{testAudio(470)},
+			segments: []int{6016, 4011},
+			starts:   [][]int{{0, 282, 470}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := makeTestMP4(tt.tracks...)
+			idx, err := NewHLSIndex(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var segments []int
+			for _, d := range idx.Segments {
+				segments = append(segments, int(d.Round(time.Millisecond)/time.Millisecond))
+			}
+			if !reflect.DeepEqual(segments, tt.segments) {
+				t.Errorf("got segments %v, want %v", segments, tt.segments)
+			}
+			if !reflect.DeepEqual(idx.starts, tt.starts) {
+				t.Errorf("got starts %v, want %v", idx.starts, tt.starts)
+			}
+			if idx.Bandwidth <= 0 {
+				t.Errorf("got bandwidth %d", idx.Bandwidth)
+			}
+		})
+	}
+}
+
+func TestNewHLSIndexErrors(t *testing.T) {
+	video := testVideo(30, 10)
+	empty := video
+	empty.sizes = nil
+	empty.sync = nil
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"empty", nil},
+		{"no moov", makeBox("ftyp", []byte("isom"), be32(0))},
+		{"truncated", makeTestMP4(video)[:100]},
+		{"no samples", makeTestMP4(empty)},
+		{"no tracks", append(makeBox("ftyp", []byte("isom"), be32(0)),
+			makeBox("moov", makeBox("mvhd", fullBox(0, 0, 1000, 0), make([]byte, 80)))...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHLSIndex(bytes.NewReader(tt.file), int64(len(tt.file)))
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestHLSIndexSegment(t *testing.T) {
+	tracks := []testTrack{testVideo(300, 45), testAudio(470)}
+	b := makeTestMP4(tracks...)
+	r := bytes.NewReader(b)
+	idx, err := NewHLSIndex(r, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range idx.Segments {
+		seg, err := idx.Segment(r, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, trafs, _ := parseFragment(t, seg)
+		if seq != uint32(n+1) {
+			t.Errorf("segment %d: got sequence number %d", n, seq)
+		}
+		if len(trafs) != len(tracks) {
+			t.Fatalf("segment %d: got %d track fragments", n, len(trafs))
+		}
+		for i, traf := range trafs {
+			tt := tracks[i]
+			first, end := idx.starts[i][n], idx.starts[i][n+1]
+			if traf.ID != uint32(i+1) {
+				t.Errorf("segment %d track %d: got id %d", n, i, traf.ID)
+			}
+			if traf.DTS != uint64(first)*uint64(tt.delta) {
+				t.Errorf("segment %d track %d: got dts %d", n, i, traf.DTS)
+			}
+			if len(traf.Samples) != end-first {
+				t.Fatalf("segment %d track %d: got %d samples, want %d", n, i, len(traf.Samples), end-first)
+			}
+			// every segment starts with a keyframe
+			if !traf.Samples[0].Sync {
+				t.Errorf("segment %d track %d: first sample isn't a sync sample", n, i)
+			}
+			off := int(traf.DataOffset)
+			for j, s := range traf.Samples {
+				want := testSample(i, first+j, tt.sizes[first+j])
+				got := seg[off : off+int(s.Size)]
+				if !bytes.Equal(got, want) {
+					t.Errorf("segment %d track %d sample %d: data doesn't match", n, i, j)
+				}
+				off += int(s.Size)
+			}
+		}
+	}
+	for _, n := range []int{-1, len(idx.Segments)} {
+		_, err := idx.Segment(r, n)
+		if err == nil {
+			t.Errorf("segment %d: got no error", n)
+		}
+	}
+}
+
+func TestHLSIndexInit(t *testing.T) {
+	b := makeTestMP4(testVideo(30, 10), testAudio(47))
+	idx, err := NewHLSIndex(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := idx.Init()
+	r := bytes.NewReader(seg)
+	top, err := readBoxes(r, 0, int64(len(seg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := boxTypes(top); !reflect.DeepEqual(got, []string{"ftyp", "moov"}) {
+		t.Fatalf("got boxes %v", got)
+	}
+	moov, err := readBoxes(r, top[1].Offset, top[1].Offset+top[1].Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := boxTypes(moov); !reflect.DeepEqual(got, []string{"mvhd", "trak", "trak", "mvex"}) {
+		t.Errorf("got moov boxes %v", got)
+	}
+	// the codecs are still found in the initialization segment
+	info, err := ReadMP4Info(r, int64(len(seg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.VideoCodec != "avc1.64001f" || info.AudioCodec != "mp4a" {
+		t.Errorf("got codecs %q and %q", info.VideoCodec, info.AudioCodec)
+	}
+}
+
+// boxTypes returns the types of boxes.
+func boxTypes(boxes []mp4Box) []string {
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.Type)
+	}
+	return types
+}
+
+func TestHLSCache(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.ToSlash(filepath.Join(dir, "v.mp4"))
+	err := ioutil.WriteFile(fp, makeTestMP4(testVideo(300, 45)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewHLSCache(1 << 20)
+	v := &Video{Path: fp, Hash: "a"}
+	idx, err := c.Get(LocalStorage{}, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := c.Get(LocalStorage{}, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != idx {
+		t.Error("index wasn't cached")
+	}
+	// a new hash means the file changed
+	changed, err := c.Get(LocalStorage{}, &Video{Path: fp, Hash: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == idx {
+		t.Error("index of changed file was cached")
+	}
+	// errors aren't cached
+	missing := &Video{Path: fp + ".missing", Hash: "a"}
+	_, err = c.Get(LocalStorage{}, missing)
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if len(c.items) != 2 {
+		t.Errorf("got %d cached items, want 2", len(c.items))
+	}
+	// the least recently used index is evicted when full
+	c.MaxMemory = idx.size()
+	_, err = c.Get(LocalStorage{}, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.ToSlash(filepath.Join(dir, "w.mp4"))
+	err = ioutil.WriteFile(other, makeTestMP4(testVideo(60, 30)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(LocalStorage{}, &Video{Path: other, Hash: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.items) != 1 || c.size > c.MaxMemory {
+		t.Errorf("got %d cached items of %d bytes", len(c.items), c.size)
+	}
+}
@@ -0,0 +1,312 @@
+package media
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxImportErrors is the number of recent failures kept by ImportStatus.
+const maxImportErrors = 100
+
+// importPublishInterval is how often videos are published while importing so
+// the library fills in as it goes.
+const importPublishInterval = time.Second
+
+// importLogInterval is how often progress is logged while importing.
+const importLogInterval = 10 * time.Second
+
+// ImportStatus reports the progress of importing library paths since the
+// library was created.
+type ImportStatus struct {
+	Running  bool           `json:"running"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Scanned  int            `json:"scanned"`
+	Added    int            `json:"added"`
+	Failed   int            `json:"failed"`
+	Errors   []*ImportError `json:"errors,omitempty"`
+}
+
+// ImportError describes a file that failed to import.
+type ImportError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// importProgress tracks the ImportStatus of a Library.
+type importProgress struct {
+	mu      sync.Mutex
+	running int
+	status  ImportStatus
+}
+
+// begin marks the start of an import.
+func (ip *importProgress) begin() {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	if ip.running == 0 {
+		ip.status.Running = true
+		ip.status.Started = time.Now()
+	}
+	ip.running++
+}
+
+// end marks the end of an import.
+func (ip *importProgress) end() {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ip.running--
+	if ip.running == 0 {
+		ip.status.Running = false
+		ip.status.Finished = time.Now()
+	}
+}
+
+// scan counts a file found while importing.
+func (ip *importProgress) scan() {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ip.status.Scanned++
+}
+
+// done counts the result of importing file fp.
+func (ip *importProgress) done(fp string, err error) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	if err == nil {
+		ip.status.Added++
+		return
+	}
+	ip.status.Failed++
+	errs := append(ip.status.Errors, &ImportError{Path: fp, Error: err.Error()})
+	if len(errs) > maxImportErrors {
+		errs = errs[len(errs)-maxImportErrors:]
+	}
+	ip.status.Errors = errs
+}
+
+// get returns a copy of the current ImportStatus.
+func (ip *importProgress) get() ImportStatus {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	s := ip.status
+	s.Errors = make([]*ImportError, len(ip.status.Errors))
+	copy(s.Errors, ip.status.Errors)
+	return s
+}
+
+// ImportStatus returns the progress of importing library paths.
+func (lib *Library) ImportStatus() ImportStatus {
+	return lib.progress.get()
+}
+
+// Import adds all valid videos from a given path and its subdirectories.
+func (lib *Library) Import(p *Path) error {
+	return lib.ImportDir(p.Path)
+}
+
+// ImportDir adds all valid videos from a directory inside of a library path,
+// including any nested subdirectories. Files are parsed in parallel by
+// lib.Workers goroutines and published as they're added.
+func (lib *Library) ImportDir(dir string) error {
+	lib.progress.begin()
+	defer lib.progress.end()
+	workers := lib.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	var scanned, failed int64
+	files := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fp := range files {
+				err := lib.importFile(fp)
+				if err == errPathRemoved {
+					continue
+				}
+				if err != nil {
+					log.Println("Import error:", fp, err)
+					atomic.AddInt64(&failed, 1)
+				}
+				lib.progress.done(fp, err)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go lib.publishImport(done)
+	err := lib.Storage(dir).Walk(dir, func(fp string, info os.FileInfo) error {
+		_, ok := TypeByExt(path.Ext(fp))
+		if !ok {
+			// Ignore files that aren't videos
+			return nil
+		}
+		if !lib.hasPath(fp) {
+			// stop early when the library path is removed while importing
+			return errPathRemoved
+		}
+		lib.progress.scan()
+		scanned++
+		files <- fp
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	close(done)
+	if err == errPathRemoved {
+		log.Println("Import stopped:", dir, "(library path removed)")
+		return nil
+	}
+	log.Printf("Imported: %s (%d scanned, %d added, %d failed)", dir, scanned, scanned-failed, failed)
+	return err
+}
+
+// ReimportPath parses the videos of a library path again with new settings p
+// (for the same directory) and swaps them in at once when done, so the videos
+// of the path stay available in the meantime. Nothing changes if the path
+// can't be read.
+func (lib *Library) ReimportPath(p *Path) error {
+	lib.mu.Lock()
+	old, ok := lib.Paths[p.Path]
+	dup := false
+	for _, p2 := range lib.Paths {
+		if p2 != old && p2.Prefix == p.Prefix {
+			dup = true
+		}
+	}
+	lib.mu.Unlock()
+	if !ok {
+		return errors.New("media: library path not found")
+	}
+	if dup {
+		return errors.New("media: duplicate library prefix")
+	}
+	workers := lib.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	var mu sync.Mutex
+	var videos []*Video
+	files := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fp := range files {
+				lib.mu.RLock()
+				lp, n, ok := lib.lookupPath(fp)
+				lib.mu.RUnlock()
+				if !ok || lp != old {
+					// nested library paths are left alone
+					continue
+				}
+				v, err := lib.parse(p, n)
+				if err != nil {
+					log.Println("Import error:", fp, err)
+					continue
+				}
+				mu.Lock()
+				videos = append(videos, v)
+				mu.Unlock()
+			}
+		}()
+	}
+	err := p.storage().Walk(p.Path, func(fp string, info os.FileInfo) error {
+		_, ok := TypeByExt(path.Ext(fp))
+		if ok {
+			files <- fp
+		}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	if lib.Paths[p.Path] != old {
+		// the path was removed or changed again while parsing
+		return errPathRemoved
+	}
+	// videos that are parsed again are updated in place rather than removed
+	// and added again
+	parsed := make(map[string]bool, len(videos))
+	for _, v := range videos {
+		parsed[v.Path] = true
+	}
+	for _, v := range lib.Videos {
+		vp, _, ok := lib.lookupPath(v.Path)
+		if ok && vp == old && !parsed[v.Path] {
+			lib.remove(v)
+		}
+	}
+	lib.Paths[p.Path] = p
+	for _, v := range videos {
+		lib.insert(v)
+	}
+	log.Printf("Reimported: %s (%d videos)", p.Path, len(videos))
+	return nil
+}
+
+// publishImport periodically publishes the videos added while importing and
+// logs progress until done is closed.
+func (lib *Library) publishImport(done <-chan struct{}) {
+	publish := time.NewTicker(importPublishInterval)
+	defer publish.Stop()
+	progress := time.NewTicker(importLogInterval)
+	defer progress.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-publish.C:
+			lib.Publish()
+		case <-progress.C:
+			s := lib.ImportStatus()
+			log.Printf("Importing: %d scanned, %d added, %d failed", s.Scanned, s.Added, s.Failed)
+		}
+	}
+}
+
+// errPathRemoved is returned when importing files of a removed library path.
+var errPathRemoved = errors.New("media: library path removed")
+
+// hasPath returns true if file path fp is inside of a library path.
+func (lib *Library) hasPath(fp string) bool {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	_, _, ok := lib.lookupPath(fp)
+	return ok
+}
+
+// importFile parses and adds a single video. lib.mu isn't held while the
+// file is parsed so other files can be added in the meantime.
+func (lib *Library) importFile(fp string) error {
+	lib.mu.RLock()
+	p, n, ok := lib.lookupPath(fp)
+	lib.mu.RUnlock()
+	if !ok {
+		return errors.New("media: path not found")
+	}
+	v, err := lib.parse(p, n)
+	if err != nil {
+		return err
+	}
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	if lib.Paths[p.Path] != p {
+		// the path was removed while parsing
+		return errPathRemoved
+	}
+	return lib.insert(v)
+}
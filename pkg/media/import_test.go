@@ -0,0 +1,52 @@
+package media
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestReimportPath(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	for _, name := range []string{"a.mp4", "b.mp4"} {
+		err := ioutil.WriteFile(path.Join(dir, name), makeTestMP4(testVideo(30, 10)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lib := NewLibrary()
+	err := lib.AddPath(&Path{Path: dir, Prefix: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lib.ImportDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib.Publish()
+	err = lib.ReimportPath(&Path{Path: dir, Prefix: "new", Visibility: Unlisted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := lib.Publish()
+	for _, id := range []string{"new/a", "new/b"} {
+		v, ok := snap.Video(id)
+		if !ok {
+			t.Fatalf("missing video %s", id)
+		}
+		if v.Visibility != Unlisted {
+			t.Errorf("%s: got visibility %q", id, v.Visibility)
+		}
+	}
+	if len(snap.Videos) != 2 {
+		t.Errorf("got %d videos, want 2", len(snap.Videos))
+	}
+	if to, ok := snap.Redirect("old/a"); !ok || to != "new/a" {
+		t.Errorf("got redirect %q, want new/a", to)
+	}
+	err = lib.ReimportPath(&Path{Path: dir + "/missing"})
+	if err == nil {
+		t.Error("got no error for unknown path")
+	}
+}
@@ -0,0 +1,296 @@
+package media
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexVersion must be incremented whenever the format of Video changes so
+// that indexes written by older versions are discarded.
+const indexVersion = 15
+
+// Index is a persistent cache of parsed Video metadata so unchanged files
+// don't need to be parsed again every time the library is imported.
+type Index struct {
+	mu        sync.Mutex
+	path      string
+	key       []byte
+	dirty     bool
+	Entries   map[string]*IndexEntry
+	redirects map[string]string
+	// dirs caches directory listings briefly so importing a directory
+	// doesn't list it again for every video
+	dirs map[string]dirListing
+}
+
+// dirListingTTL is how long a directory listing is cached by an Index.
+const dirListingTTL = 10 * time.Second
+
+// dirListing is a cached directory listing.
+type dirListing struct {
+	names []string
+	at    time.Time
+}
+
+// indexFile is the format of the Index on disk.
+type indexFile struct {
+	Version   int                    `json:"version"`
+	Entries   map[string]*IndexEntry `json:"entries"`
+	Redirects map[string]string      `json:"redirects"`
+}
+
+// IndexEntry stores a parsed Video along with the file attributes used to
+// detect when the file has changed. Changes to the related files of the Video
+// or to the files beside it that could be (its sidecar, captions and images)
+// also invalidate it. Passwords are only stored as hashes.
+type IndexEntry struct {
+	Path              Path                 `json:"path"`
+	PasswordHash      string               `json:"password_hash,omitempty"`
+	Size              int64                `json:"size"`
+	ModTime           time.Time            `json:"mtime"`
+	Siblings          []string             `json:"siblings"`
+	Related           map[string]time.Time `json:"related"`
+	Video             *Video               `json:"video"`
+	VideoPasswordHash string               `json:"video_password_hash,omitempty"`
+}
+
+// OpenIndex returns an Index stored at path with passwords hashed using key.
+// A missing file results in an empty Index that will be created on the next
+// Save.
+func OpenIndex(path string, key []byte) (*Index, error) {
+	idx := &Index{
+		path:      path,
+		key:       key,
+		Entries:   make(map[string]*IndexEntry),
+		redirects: make(map[string]string),
+		dirs:      make(map[string]dirListing),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var file indexFile
+	err = json.NewDecoder(f).Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+	if file.Version == indexVersion && file.Entries != nil {
+		idx.Entries = file.Entries
+	}
+	// redirects are kept even if the entries are outdated
+	if file.Redirects != nil {
+		idx.redirects = file.Redirects
+	}
+	return idx, nil
+}
+
+// Get returns the cached Video for file path fp if it's still up to date.
+func (idx *Index) Get(p *Path, fp string, info os.FileInfo) (*Video, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.Entries[fp]
+	if !ok || e.Video == nil {
+		return nil, false
+	}
+	if e.Path != p.settings() || e.PasswordHash != idx.passwordHash(fp, p.Password) {
+		// settings of the library path changed
+		return nil, false
+	}
+	if e.Size != info.Size() {
+		return nil, false
+	}
+	if !e.ModTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	s := p.storage()
+	sibs, err := idx.siblings(s, fp)
+	if err != nil || !equalStrings(sibs, e.Siblings) {
+		// sidecar, caption or image files were added or removed
+		return nil, false
+	}
+	for rp, t := range e.Related {
+		if !t.Equal(modTime(s, rp)) {
+			return nil, false
+		}
+	}
+	// the password isn't stored so it's read again from the path or sidecar
+	pw := p.Password
+	_, ok = e.Related[sidecarPath(fp)]
+	if ok {
+		sc, err := readSidecar(s, fp)
+		if err != nil {
+			return nil, false
+		}
+		if sc != nil && len(sc.Password) > 0 {
+			pw = sc.Password
+		}
+	}
+	if idx.passwordHash(fp, pw) != e.VideoPasswordHash {
+		return nil, false
+	}
+	v := *e.Video
+	v.Password = pw
+	return &v, true
+}
+
+// Put stores a parsed Video for file path fp.
+func (idx *Index) Put(p *Path, fp string, info os.FileInfo, v *Video) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	s := p.storage()
+	related := make(map[string]time.Time, len(v.Related))
+	for _, rp := range v.Related {
+		related[rp] = modTime(s, rp)
+	}
+	sibs, err := idx.siblings(s, fp)
+	if err != nil {
+		return
+	}
+	idx.Entries[fp] = &IndexEntry{
+		Path:              p.settings(),
+		PasswordHash:      idx.passwordHash(fp, p.Password),
+		Size:              info.Size(),
+		ModTime:           info.ModTime(),
+		Siblings:          sibs,
+		Related:           related,
+		Video:             v,
+		VideoPasswordHash: idx.passwordHash(fp, v.Password),
+	}
+	idx.dirty = true
+}
+
+// siblings returns the sorted names of the files beside file path fp that
+// could change its Video: its sidecar, captions and images, whether or not
+// they're used (idx.mu must be held).
+func (idx *Index) siblings(s Storage, fp string) ([]string, error) {
+	dir := path.Dir(fp)
+	l, ok := idx.dirs[dir]
+	if !ok || time.Since(l.at) > dirListingTTL {
+		names, err := s.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		l = dirListing{names: names, at: time.Now()}
+		idx.dirs[dir] = l
+	}
+	name := path.Base(fp)
+	base := strings.ToLower(strings.TrimSuffix(name, path.Ext(name))) + "."
+	sibs := []string{}
+	for _, n := range l.names {
+		if n != name && (strings.HasPrefix(strings.ToLower(n), base) || isFolderThumb(n)) {
+			sibs = append(sibs, n)
+		}
+	}
+	sort.Strings(sibs)
+	return sibs, nil
+}
+
+// equalStrings returns true if a and b hold the same strings in order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// passwordHash returns a hash of a password used for file path fp (empty if
+// there's no password) so changes can be detected without storing it. It's
+// keyed so passwords can't be guessed from the index alone.
+func (idx *Index) passwordHash(fp, password string) string {
+	if len(password) == 0 {
+		return ""
+	}
+	return keyedHash(idx.key, fp+"\x00"+password)
+}
+
+// Delete removes file path fp from the Index.
+func (idx *Index) Delete(fp string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	// the file is deleted when files beside it changed so they're listed
+	// again
+	delete(idx.dirs, path.Dir(fp))
+	_, ok := idx.Entries[fp]
+	if ok {
+		delete(idx.Entries, fp)
+		idx.dirty = true
+	}
+}
+
+// Prune removes entries for files that no longer exist (according to stat)
+// and returns their videos.
+func (idx *Index) Prune(stat func(fp string) (os.FileInfo, error)) []*Video {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var pruned []*Video
+	for fp, e := range idx.Entries {
+		_, err := stat(fp)
+		if os.IsNotExist(err) {
+			delete(idx.Entries, fp)
+			idx.dirty = true
+			if e.Video != nil {
+				pruned = append(pruned, e.Video)
+			}
+		}
+	}
+	return pruned
+}
+
+// Redirects returns a copy of the stored video ID redirects.
+func (idx *Index) Redirects() map[string]string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	m := make(map[string]string, len(idx.redirects))
+	for from, to := range idx.redirects {
+		m[from] = to
+	}
+	return m
+}
+
+// SetRedirects stores a copy of video ID redirects.
+func (idx *Index) SetRedirects(redirects map[string]string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.redirects = make(map[string]string, len(redirects))
+	for from, to := range redirects {
+		idx.redirects[from] = to
+	}
+	idx.dirty = true
+}
+
+// Save writes the Index to disk if it has changed since it was last saved.
+func (idx *Index) Save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.dirty {
+		return nil
+	}
+	b, err := json.Marshal(&indexFile{
+		Version:   indexVersion,
+		Entries:   idx.Entries,
+		Redirects: idx.redirects,
+	})
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash never leaves a partial index
+	err = writeFile(idx.path, b)
+	if err != nil {
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
@@ -0,0 +1,62 @@
+package media
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexGetSiblings(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	p := &Path{Path: dir}
+	write := func(name string) {
+		err := ioutil.WriteFile(path.Join(dir, name), makeTestMP4(testVideo(30, 10)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.mp4")
+	fp := path.Join(dir, "a.mp4")
+	info, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := &Index{
+		Entries: make(map[string]*IndexEntry),
+		dirs:    make(map[string]dirListing),
+	}
+	v, err := ParseVideo(p, "a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Put(p, fp, info, v)
+	tests := []struct {
+		name string
+		file string
+		ok   bool
+	}{
+		{"unchanged", "", true},
+		{"other video", "b.mp4", true},
+		{"other caption", "b.en.vtt", true},
+		{"caption", "a.en.vtt", false},
+		{"sidecar", "a.json", false},
+		{"image", "A.JPG", false},
+		{"folder image", "cover.png", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.file) > 0 {
+				write(tt.file)
+				defer os.Remove(path.Join(dir, tt.file))
+			}
+			// listings are cached so they're dropped to see the new file
+			idx.dirs = make(map[string]dirListing)
+			_, ok := idx.Get(p, fp, info)
+			if ok != tt.ok {
+				t.Errorf("got cached %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
@@ -2,31 +2,140 @@ package media
 
 import (
 	"errors"
-	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Library manages importing and retrieving video data.
+// Library manages importing and retrieving video data. Changes only become
+// visible to readers of Snapshot once they're published with Publish.
 type Library struct {
-	mu     sync.RWMutex
-	Paths  map[string]*Path
+	mu    sync.RWMutex
+	Paths map[string]*Path
+	// Videos is the working set of videos (guarded by mu, use Snapshot to
+	// read it without locking)
 	Videos map[string]*Video
+	// Redirects maps the old IDs of videos that moved to their current ID
+	Redirects map[string]string
+	// Index caches parsed metadata between runs (disabled when nil)
+	Index  *Index
+	search *searchIndex
+	// ids maps file paths to the ID of their video
+	ids map[string]string
+	// moved maps content hashes of removed videos to their ID
+	moved map[string]string
+	// collisions maps file paths that weren't added because their ID was
+	// already in use to that ID
+	collisions map[string]string
+	// Workers is the number of files parsed in parallel when importing
+	// (defaults to the number of CPUs)
+	Workers  int
+	progress importProgress
+	// pending holds the events since the last Publish
+	pending []Event
+	subs    map[*Subscription]struct{}
+	// released is when scheduled videos were last checked for release
+	released time.Time
+	// changes maps video IDs to the version they were last changed in
+	changes map[string]int64
+	// listed holds the listed state of changed videos from each version they
+	// were changed in
+	listed map[string][]listing
+	// snap holds the latest published *Snapshot
+	snap    atomic.Value
+	version int64
+	base    int64
 }
 
 // NewLibrary returns new instance of Library.
 func NewLibrary() *Library {
 	lib := &Library{
-		Paths:  make(map[string]*Path),
-		Videos: make(map[string]*Video),
+		Paths:      make(map[string]*Path),
+		Videos:     make(map[string]*Video),
+		Redirects:  make(map[string]string),
+		search:     newSearchIndex(),
+		ids:        make(map[string]string),
+		moved:      make(map[string]string),
+		collisions: make(map[string]string),
+		subs:       make(map[*Subscription]struct{}),
+		released:   time.Now(),
+		changes:    make(map[string]int64),
+		listed:     make(map[string][]listing),
 	}
+	// versions start from the time in milliseconds so they keep increasing
+	// across restarts
+	lib.base = time.Now().UnixNano() / int64(time.Millisecond)
+	lib.version = lib.base
+	lib.snap.Store(newSnapshot(lib, lib.version))
 	return lib
 }
 
+// Publish makes the current state of the library visible to readers by
+// swapping in a new Snapshot and sends the events since the last Publish to
+// subscribers.
+func (lib *Library) Publish() *Snapshot {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.release(time.Now())
+	lib.version++
+	for _, e := range lib.pending {
+		id := e.Video.ID
+		if lib.changes[id] == lib.version {
+			continue
+		}
+		lib.changes[id] = lib.version
+		l := listing{Version: lib.version}
+		v, ok := lib.Videos[id]
+		if ok && v.Listed() {
+			l.Video = v
+		}
+		lib.listed[id] = append(lib.listed[id], l)
+	}
+	s := newSnapshot(lib, lib.version)
+	lib.snap.Store(s)
+	lib.dispatch()
+	return s
+}
+
+// Snapshot returns the latest published Snapshot.
+func (lib *Library) Snapshot() *Snapshot {
+	return lib.snap.Load().(*Snapshot)
+}
+
+// SetIndex sets the Index used to cache metadata and loads the redirects
+// stored in it.
+func (lib *Library) SetIndex(idx *Index) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.Index = idx
+	for from, to := range idx.Redirects() {
+		lib.Redirects[from] = to
+	}
+}
+
+// PruneIndex removes Index entries for files deleted while the library wasn't
+// running. Videos now found at another path are treated as having moved.
+func (lib *Library) PruneIndex() {
+	if lib.Index == nil {
+		return
+	}
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	pruned := lib.Index.Prune(lib.stat)
+	for _, old := range pruned {
+		lib.moved[old.Hash] = old.ID
+	}
+	for _, v := range lib.Videos {
+		lib.checkMoved(v)
+	}
+}
+
 // AddPath adds a media path to the library.
 func (lib *Library) AddPath(p *Path) error {
 	lib.mu.Lock()
@@ -44,79 +153,326 @@ func (lib *Library) AddPath(p *Path) error {
 	return nil
 }
 
-// Import adds all valid videos from a given path.
-func (lib *Library) Import(p *Path) error {
-	files, err := ioutil.ReadDir(p.Path)
-	if err != nil {
-		return err
+// RemovePath removes a media path and all of its videos from the library.
+// Videos of other library paths nested inside of it are kept. The videos are
+// removed together so the next Publish drops all of them at once, and their
+// Index entries are kept so adding the path again doesn't parse every file.
+func (lib *Library) RemovePath(dir string) error {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	p, ok := lib.Paths[dir]
+	if !ok {
+		return errors.New("media: library path not found")
 	}
-	for _, info := range files {
-		err = lib.Add(path.Join(p.Path, info.Name()))
-		if err != nil {
-			// Ignore files that can't be parsed
-			continue
+	for _, v := range lib.Videos {
+		vp, _, ok := lib.lookupPath(v.Path)
+		if ok && vp == p {
+			lib.remove(v)
 		}
 	}
+	for cp := range lib.collisions {
+		cpp, _, ok := lib.lookupPath(cp)
+		if ok && cpp == p {
+			delete(lib.collisions, cp)
+		}
+	}
+	delete(lib.Paths, dir)
 	return nil
 }
 
-// Add adds a single video from a given file path.
+// Add adds a single video from a given file path. If the file isn't a video
+// any videos it's related to (such as by being their sidecar) are updated.
 func (lib *Library) Add(fp string) error {
 	lib.mu.Lock()
 	defer lib.mu.Unlock()
 	fp = filepath.ToSlash(fp)
-	d := path.Dir(fp)
-	p, ok := lib.Paths[d]
+	_, ok := TypeByExt(path.Ext(fp))
+	if !ok {
+		lib.refresh(fp)
+		return nil
+	}
+	return lib.add(fp)
+}
+
+// add parses and adds a single video (lib.mu must be held).
+func (lib *Library) add(fp string) error {
+	p, n, ok := lib.lookupPath(fp)
 	if !ok {
 		return errors.New("media: path not found")
 	}
-	n := path.Base(fp)
-	v, err := ParseVideo(p, n)
+	v, err := lib.parse(p, n)
 	if err != nil {
 		return err
 	}
+	return lib.insert(v)
+}
+
+// insert adds a parsed video unless its ID is used by another file (lib.mu
+// must be held).
+func (lib *Library) insert(v *Video) error {
+	old, exists := lib.Videos[v.ID]
+	if exists && old.Path != v.Path {
+		log.Println("Collision:", v.ID, "used by", old.Path, "and", v.Path)
+		lib.collisions[v.Path] = v.ID
+		return errors.New("media: duplicate video ID")
+	}
+	delete(lib.collisions, v.Path)
+	prev, ok := lib.ids[v.Path]
+	if ok && prev != v.ID {
+		// ID of the file changed (such as from a sidecar)
+		lib.remove(lib.Videos[prev])
+	}
+	if exists {
+		lib.emit(Updated, v, old)
+	} else {
+		lib.emit(Added, v, nil)
+	}
 	lib.Videos[v.ID] = v
+	lib.ids[v.Path] = v.ID
 	log.Println("Added:", v.Path)
+	lib.checkMoved(v)
 	return nil
 }
 
-// Remove removes a single video from a given file path.
+// remove removes a video from the library (lib.mu must be held).
+func (lib *Library) remove(v *Video) {
+	delete(lib.Videos, v.ID)
+	delete(lib.ids, v.Path)
+	lib.emit(Removed, v, nil)
+	lib.moved[v.Hash] = v.ID
+	log.Println("Removed:", v.Path)
+}
+
+// checkMoved adds a redirect if the content of v was previously removed from
+// a video with another ID (lib.mu must be held).
+func (lib *Library) checkMoved(v *Video) {
+	_, ok := lib.Redirects[v.ID]
+	if ok {
+		// the ID is in use again
+		delete(lib.Redirects, v.ID)
+		lib.saveRedirects()
+	}
+	old, ok := lib.moved[v.Hash]
+	if !ok {
+		return
+	}
+	delete(lib.moved, v.Hash)
+	if old == v.ID {
+		return
+	}
+	log.Println("Moved:", old, "to", v.ID)
+	lib.Redirects[old] = v.ID
+	// update redirects that pointed to the old ID
+	for from, to := range lib.Redirects {
+		if to == old {
+			lib.Redirects[from] = v.ID
+		}
+	}
+	lib.saveRedirects()
+}
+
+// saveRedirects copies Redirects to the Index (lib.mu must be held).
+func (lib *Library) saveRedirects() {
+	if lib.Index != nil {
+		lib.Index.SetRedirects(lib.Redirects)
+	}
+}
+
+// Redirect returns the current ID of a video that was moved from id.
+func (lib *Library) Redirect(id string) (string, bool) {
+	return lib.Snapshot().Redirect(id)
+}
+
+// refresh parses all videos related to file path fp again (lib.mu must be
+// held).
+func (lib *Library) refresh(fp string) {
+	var paths []string
+	for _, v := range lib.Videos {
+		if v.IsRelated(fp) {
+			paths = append(paths, v.Path)
+		}
+	}
+	for _, vp := range paths {
+		if lib.Index != nil {
+			// new related files don't always change the cached attributes
+			// (object stores have no directory modification times)
+			lib.Index.Delete(vp)
+		}
+		lib.add(vp)
+	}
+}
+
+// parse returns the Video for file name in library path p, using the Index
+// when the file hasn't changed since it was last parsed.
+func (lib *Library) parse(p *Path, name string) (*Video, error) {
+	if lib.Index == nil {
+		return ParseVideo(p, name)
+	}
+	fp := path.Join(p.Path, name)
+	info, err := p.storage().Stat(fp)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := lib.Index.Get(p, fp, info)
+	if ok {
+		return v, nil
+	}
+	v, err = ParseVideo(p, name)
+	if err != nil {
+		return nil, err
+	}
+	lib.Index.Put(p, fp, info, v)
+	return v, nil
+}
+
+// Remove removes a single video from a given file path. If the path is a
+// directory every video nested inside of it is removed. If a file related to
+// videos was deleted those videos are updated.
 func (lib *Library) Remove(fp string) {
 	lib.mu.Lock()
 	defer lib.mu.Unlock()
 	fp = filepath.ToSlash(fp)
-	d := path.Dir(fp)
-	p, ok := lib.Paths[d]
-	if !ok {
-		return
+	dir := fp + "/"
+	var freed []string
+	for _, v := range lib.Videos {
+		if v.Path == fp || strings.HasPrefix(v.Path, dir) {
+			lib.remove(v)
+			if lib.Index != nil {
+				lib.Index.Delete(v.Path)
+			}
+			freed = append(freed, v.ID)
+		}
 	}
-	n := path.Base(fp)
-	// ID is name without extension
-	idx := strings.LastIndex(n, ".")
-	if idx == -1 {
-		idx = len(n)
+	for cp := range lib.collisions {
+		if cp == fp || strings.HasPrefix(cp, dir) {
+			delete(lib.collisions, cp)
+		}
 	}
-	id := n[:idx]
-	if len(p.Prefix) > 0 {
-		id = path.Join(p.Prefix, id)
+	// add videos that were waiting on a freed ID
+	for _, id := range freed {
+		for cp, cid := range lib.collisions {
+			if cid == id {
+				lib.add(cp)
+				break
+			}
+		}
 	}
-	v, ok := lib.Videos[id]
-	if ok {
-		delete(lib.Videos, id)
-		log.Println("Removed:", v.Path)
+	_, ok := TypeByExt(path.Ext(fp))
+	_, err := lib.stat(fp)
+	if !ok && os.IsNotExist(err) {
+		// files that still exist were only modified and will be handled by
+		// a following Add
+		lib.refresh(fp)
 	}
 }
 
-// Playlist returns a sorted Playlist of all videos.
-func (lib *Library) Playlist() Playlist {
+// Storage returns the Storage holding file path fp (the local filesystem for
+// files outside of library paths).
+func (lib *Library) Storage(fp string) Storage {
 	lib.mu.RLock()
 	defer lib.mu.RUnlock()
-	pl := make(Playlist, len(lib.Videos))
-	i := 0
-	for _, v := range lib.Videos {
-		pl[i] = v
-		i++
+	return lib.storage(fp)
+}
+
+// storage returns the Storage holding file path fp (lib.mu must be held).
+func (lib *Library) storage(fp string) Storage {
+	p, ok := lib.Paths[filepath.ToSlash(fp)]
+	if !ok {
+		p, _, ok = lib.lookupPath(fp)
+	}
+	if !ok {
+		return LocalStorage{}
+	}
+	return p.storage()
+}
+
+// stat returns the attributes of file path fp from its Storage (lib.mu must
+// be held).
+func (lib *Library) stat(fp string) (os.FileInfo, error) {
+	return lib.storage(fp).Stat(fp)
+}
+
+// lookupPath returns the library Path containing file path fp and the name of
+// the file relative to that Path.
+func (lib *Library) lookupPath(fp string) (*Path, string, bool) {
+	fp = filepath.ToSlash(fp)
+	// walk up parent directories until a library path is found so the most
+	// specific path wins when library paths are nested
+	for d := path.Dir(fp); ; d = path.Dir(d) {
+		p, ok := lib.Paths[d]
+		if ok {
+			return p, strings.TrimPrefix(fp, d+"/"), true
+		}
+		if d == "." || d == "/" {
+			return nil, "", false
+		}
+	}
+}
+
+// Playlist returns a sorted Playlist of all listed videos. It's shared with
+// other readers and must not be modified.
+func (lib *Library) Playlist() Playlist {
+	return lib.Snapshot().Playlist()
+}
+
+// Album returns a Playlist of all listed videos in an album sorted by
+// episode. It's shared with other readers and must not be modified.
+func (lib *Library) Album(album string) Playlist {
+	return lib.Snapshot().Albums[album]
+}
+
+// Search returns the listed videos matching a query (see ParseQuery) sorted by
+// relevance.
+func (lib *Library) Search(q string) Playlist {
+	query := ParseQuery(q)
+	if len(query.Terms) == 0 && len(query.Album) == 0 && len(query.Prefix) == 0 {
+		return nil
 	}
+	var scores map[string]int
+	if len(query.Terms) > 0 {
+		scores = lib.search.match(query.Terms)
+	}
+	snap := lib.Snapshot()
+	candidates := snap.Playlist()
+	if len(query.Prefix) > 0 {
+		prefixed, ok := snap.Prefixes[strings.Trim(query.Prefix, "/")]
+		if ok {
+			candidates = prefixed
+		}
+	}
+	var pl Playlist
+	for _, v := range candidates {
+		if scores != nil {
+			_, ok := scores[v.ID]
+			if !ok {
+				continue
+			}
+		}
+		if query.Matches(v) {
+			pl = append(pl, v)
+		}
+	}
+	// newest first within the same score
 	sort.Sort(pl)
+	sort.SliceStable(pl, func(i, j int) bool {
+		return scores[pl[i].ID] > scores[pl[j].ID]
+	})
 	return pl
 }
+
+// NextRelease returns the earliest publish time of scheduled videos after a
+// given time.
+func (lib *Library) NextRelease(after time.Time) (time.Time, bool) {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	var next time.Time
+	for _, v := range lib.Videos {
+		if !v.Published.After(after) {
+			continue
+		}
+		if next.IsZero() || v.Published.Before(next) {
+			next = v.Published
+		}
+	}
+	return next, !next.IsZero()
+}
@@ -0,0 +1,403 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// mp4Epoch is the start of time for MP4 creation timestamps.
+var mp4Epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// maxBoxRead limits the size of boxes read entirely into memory.
+const maxBoxRead = 1 << 16
+
+// mp4Box is the location of an MP4 box payload within a file.
+type mp4Box struct {
+	Type   string
+	Offset int64
+	Size   int64
+}
+
+// MP4Info holds technical details read from the boxes of an MP4 file.
+type MP4Info struct {
+	Duration   time.Duration
+	Created    time.Time
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+}
+
+// readBoxes returns the boxes stored between offsets start and end of r.
+func readBoxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	hdr := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		_, err := r.ReadAt(hdr[:8], off)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		typ := string(hdr[4:8])
+		hlen := int64(8)
+		if size == 1 {
+			// 64-bit largesize follows the type
+			_, err = r.ReadAt(hdr[8:16], off+8)
+			if err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hlen = 16
+		} else if size == 0 {
+			// box extends to the end
+			size = end - off
+		}
+		if size < hlen || off+size > end {
+			return nil, errors.New("media: invalid mp4 box " + typ)
+		}
+		boxes = append(boxes, mp4Box{
+			Type:   typ,
+			Offset: off + hlen,
+			Size:   size - hlen,
+		})
+		off += size
+	}
+	return boxes, nil
+}
+
+// findBox returns the first box of type typ.
+func findBox(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.Type == typ {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// childBoxes returns the boxes nested in the box at path (such as "moov",
+// "trak") starting from the boxes of parent.
+func childBoxes(r io.ReaderAt, parent mp4Box, path ...string) ([]mp4Box, error) {
+	b := parent
+	for _, typ := range path {
+		boxes, err := readBoxes(r, b.Offset, b.Offset+b.Size)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		b, ok = findBox(boxes, typ)
+		if !ok {
+			return nil, errors.New("media: missing mp4 box " + typ)
+		}
+	}
+	return readBoxes(r, b.Offset, b.Offset+b.Size)
+}
+
+// readBox reads the payload of a box into memory.
+func readBox(r io.ReaderAt, b mp4Box) ([]byte, error) {
+	if b.Size > maxBoxRead {
+		return nil, errors.New("media: mp4 box too large " + b.Type)
+	}
+	buf := make([]byte, b.Size)
+	_, err := r.ReadAt(buf, b.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ReadMP4Info parses the moov box of an MP4 (or QuickTime) file of a given
+// size to find its duration, resolution and codecs.
+func ReadMP4Info(r io.ReaderAt, size int64) (*MP4Info, error) {
+	mvhd, traks, err := readMoov(r, size)
+	if err != nil {
+		return nil, err
+	}
+	info := &MP4Info{}
+	err = info.parseMvhd(mvhd)
+	if err != nil {
+		return nil, err
+	}
+	for _, trak := range traks {
+		err = info.parseTrak(r, trak)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// readMoov returns the mvhd payload and the trak boxes of the moov box of an
+// MP4 file of a given size.
+func readMoov(r io.ReaderAt, size int64) ([]byte, []mp4Box, error) {
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return nil, nil, errors.New("media: missing mp4 box moov")
+	}
+	boxes, err := readBoxes(r, moov.Offset, moov.Offset+moov.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	mvhd, ok := findBox(boxes, "mvhd")
+	if !ok {
+		return nil, nil, errors.New("media: missing mp4 box mvhd")
+	}
+	b, err := readBox(r, mvhd)
+	if err != nil {
+		return nil, nil, err
+	}
+	var traks []mp4Box
+	for _, box := range boxes {
+		if box.Type == "trak" {
+			traks = append(traks, box)
+		}
+	}
+	return b, traks, nil
+}
+
+// mp4Trak holds the boxes of a video or audio trak box.
+type mp4Trak struct {
+	// Handler is "vide" or "soun"
+	Handler string
+	hdlr    []byte
+	boxes   []mp4Box
+	mdia    []mp4Box
+	// stbl is nil if the track has no minf box
+	stbl []mp4Box
+}
+
+// readTrak reads the boxes of a trak box down to its sample table (nil if
+// it's not a video or audio track).
+func readTrak(r io.ReaderAt, trak mp4Box) (*mp4Trak, error) {
+	boxes, err := readBoxes(r, trak.Offset, trak.Offset+trak.Size)
+	if err != nil {
+		return nil, err
+	}
+	mdia, err := childBoxes(r, trak, "mdia")
+	if err != nil {
+		return nil, err
+	}
+	hdlr, ok := findBox(mdia, "hdlr")
+	if !ok {
+		return nil, nil
+	}
+	b, err := readBox(r, hdlr)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 12 {
+		return nil, errors.New("media: invalid mp4 box hdlr")
+	}
+	t := &mp4Trak{
+		Handler: string(b[8:12]),
+		hdlr:    b,
+		boxes:   boxes,
+		mdia:    mdia,
+	}
+	if t.Handler != "vide" && t.Handler != "soun" {
+		// ignore text, hint and other tracks
+		return nil, nil
+	}
+	minf, ok := findBox(mdia, "minf")
+	if !ok {
+		return t, nil
+	}
+	t.stbl, err = childBoxes(r, minf, "stbl")
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseMvhd reads the movie duration and creation time from an mvhd payload.
+func (info *MP4Info) parseMvhd(b []byte) error {
+	var created, scale, duration uint64
+	if len(b) >= 32 && b[0] == 1 {
+		created = binary.BigEndian.Uint64(b[4:12])
+		scale = uint64(binary.BigEndian.Uint32(b[20:24]))
+		duration = binary.BigEndian.Uint64(b[24:32])
+	} else if len(b) >= 20 {
+		created = uint64(binary.BigEndian.Uint32(b[4:8]))
+		scale = uint64(binary.BigEndian.Uint32(b[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	} else {
+		return errors.New("media: invalid mp4 box mvhd")
+	}
+	if scale > 0 {
+		info.Duration = time.Duration(float64(duration) / float64(scale) * float64(time.Second))
+	}
+	if created > 0 {
+		info.Created = mp4Epoch.Add(time.Duration(created) * time.Second)
+	}
+	return nil
+}
+
+// parseTrak reads the resolution and codec of a video or audio track.
+func (info *MP4Info) parseTrak(r io.ReaderAt, trak mp4Box) error {
+	t, err := readTrak(r, trak)
+	if err != nil || t == nil {
+		return err
+	}
+	stsd, ok := findBox(t.stbl, "stsd")
+	if !ok {
+		return nil
+	}
+	b, err := readBox(r, stsd)
+	if err != nil {
+		return err
+	}
+	codec, err := parseStsd(b)
+	if err != nil {
+		return err
+	}
+	if t.Handler == "soun" {
+		if len(info.AudioCodec) == 0 {
+			info.AudioCodec = codec
+		}
+		return nil
+	}
+	if len(info.VideoCodec) > 0 {
+		return nil
+	}
+	info.VideoCodec = codec
+	tkhd, ok := findBox(t.boxes, "tkhd")
+	if !ok {
+		return nil
+	}
+	b, err = readBox(r, tkhd)
+	if err != nil {
+		return err
+	}
+	// width and height are 16.16 fixed point values at the end of tkhd
+	if len(b) >= 84 {
+		info.Width = int(binary.BigEndian.Uint32(b[len(b)-8:]) >> 16)
+		info.Height = int(binary.BigEndian.Uint32(b[len(b)-4:]) >> 16)
+	}
+	return nil
+}
+
+// parseStsd returns an RFC 6381 codec string for the first sample entry of
+// an stsd payload. Only the sample entry type is returned when the details of
+// the codec aren't known.
+func parseStsd(b []byte) (string, error) {
+	// version/flags and entry_count precede the first sample entry
+	if len(b) < 16 {
+		return "", errors.New("media: invalid mp4 box stsd")
+	}
+	entry := b[8:]
+	size := int(binary.BigEndian.Uint32(entry[0:4]))
+	if size < 8 || size > len(entry) {
+		return "", errors.New("media: invalid mp4 box stsd")
+	}
+	typ := string(entry[4:8])
+	entry = entry[8:size]
+	// sample entry fields come before child boxes
+	var skip int
+	switch typ {
+	case "avc1", "avc3", "hvc1", "hev1", "vp08", "vp09", "av01":
+		skip = 78
+	case "mp4a", "Opus", "fLaC", "ac-3", "ec-3":
+		skip = 28
+	default:
+		return typ, nil
+	}
+	if len(entry) < skip {
+		return typ, nil
+	}
+	children := entry[skip:]
+	for len(children) >= 8 {
+		n := int(binary.BigEndian.Uint32(children[0:4]))
+		if n < 8 || n > len(children) {
+			break
+		}
+		ctyp := string(children[4:8])
+		data := children[8:n]
+		switch {
+		case ctyp == "avcC" && len(data) >= 4:
+			// profile, compatibility and level follow configurationVersion
+			return fmt.Sprintf("%s.%02x%02x%02x", typ, data[1], data[2], data[3]), nil
+		case ctyp == "esds":
+			oti, aot, ok := parseEsds(data)
+			if ok {
+				return fmt.Sprintf("mp4a.%x.%d", oti, aot), nil
+			}
+		}
+		children = children[n:]
+	}
+	switch typ {
+	case "Opus":
+		return "opus", nil
+	case "fLaC":
+		return "flac", nil
+	}
+	return typ, nil
+}
+
+// parseEsds returns the object type indication and audio object type from an
+// esds payload.
+func parseEsds(b []byte) (byte, byte, bool) {
+	// skip version/flags
+	if len(b) < 4 {
+		return 0, 0, false
+	}
+	b = b[4:]
+	var oti byte
+	for len(b) >= 2 {
+		tag := b[0]
+		// descriptor length uses up to 4 bytes of 7 bits each
+		i := 1
+		for i < 4 && i < len(b) && b[i]&0x80 != 0 {
+			i++
+		}
+		if i+1 > len(b) {
+			return 0, 0, false
+		}
+		b = b[i+1:]
+		switch tag {
+		case 3:
+			// ES_Descriptor: ES_ID, flags and optional fields
+			if len(b) < 3 {
+				return 0, 0, false
+			}
+			flags := b[2]
+			b = b[3:]
+			n := 0
+			if flags&0x80 != 0 {
+				n += 2
+			}
+			if flags&0x40 != 0 && len(b) > n {
+				n += 1 + int(b[n])
+			}
+			if flags&0x20 != 0 {
+				n += 2
+			}
+			if len(b) < n {
+				return 0, 0, false
+			}
+			b = b[n:]
+		case 4:
+			// DecoderConfigDescriptor
+			if len(b) < 13 {
+				return 0, 0, false
+			}
+			oti = b[0]
+			b = b[13:]
+		case 5:
+			// DecoderSpecificInfo starts with the audio object type
+			if oti == 0 || len(b) < 1 {
+				return 0, 0, false
+			}
+			return oti, b[0] >> 3, true
+		default:
+			return 0, 0, false
+		}
+	}
+	return 0, 0, false
+}
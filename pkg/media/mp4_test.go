@@ -0,0 +1,348 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testChunkSize is the number of samples per chunk of test files.
+const testChunkSize = 10
+
+// testTrack describes a track of a handcrafted MP4 file.
+type testTrack struct {
+	handler   string
+	timescale uint32
+	// delta is the duration of every sample
+	delta uint32
+	sizes []uint32
+	// sync lists the sync samples (numbered from 1), every sample when nil
+	sync []uint32
+}
+
+// testSample returns the data of sample i of track n of a test file.
+func testSample(n, i int, size uint32) []byte {
+	return bytes.Repeat([]byte{byte(n*64 + i)}, int(size))
+}
+
+// uniformSizes returns n sample sizes of size bytes.
+func uniformSizes(n int, size uint32) []uint32 {
+	sizes := make([]uint32, n)
+	for i := range sizes {
+		sizes[i] = size
+	}
+	return sizes
+}
+
+// everyNth returns the sample numbers (from 1) of every nth of n samples.
+func everyNth(n, nth int) []uint32 {
+	var sync []uint32
+	for i := 0; i < n; i += nth {
+		sync = append(sync, uint32(i+1))
+	}
+	return sync
+}
+
+// fullBox returns the payload of a full box (version 0, no flags).
+func fullBox(fields ...uint32) []byte {
+	b := be32(0)
+	for _, f := range fields {
+		b = append(b, be32(f)...)
+	}
+	return b
+}
+
+// makeTestMP4 returns an MP4 file with the samples of each track stored one
+// track after the other in mdat, in chunks of testChunkSize samples.
+func makeTestMP4(tracks ...testTrack) []byte {
+	ftyp := makeBox("ftyp", []byte("isom"), be32(0), []byte("isomavc1"))
+	base := int64(len(ftyp) + 8)
+	var mdat []byte
+	offsets := make([][]uint32, len(tracks))
+	for n, t := range tracks {
+		for i, size := range t.sizes {
+			if i%testChunkSize == 0 {
+				offsets[n] = append(offsets[n], uint32(base+int64(len(mdat))))
+			}
+			mdat = append(mdat, testSample(n, i, size)...)
+		}
+	}
+	// movie timescale is in milliseconds
+	var duration uint32
+	for _, t := range tracks {
+		d := uint32(uint64(len(t.sizes)) * uint64(t.delta) * 1000 / uint64(t.timescale))
+		if d > duration {
+			duration = d
+		}
+	}
+	moov := [][]byte{makeBox("mvhd", fullBox(0, 0, 1000, duration), make([]byte, 80))}
+	for n, t := range tracks {
+		moov = append(moov, makeTestTrak(uint32(n+1), t, offsets[n]))
+	}
+	b := append(ftyp, makeBox("mdat", mdat)...)
+	return append(b, makeBox("moov", moov...)...)
+}
+
+// makeTestTrak returns the trak box of track id with chunk offsets.
+func makeTestTrak(id uint32, t testTrack, offsets []uint32) []byte {
+	n := uint32(len(t.sizes))
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[12:16], id)
+	var entry, mhd []byte
+	if t.handler == "vide" {
+		// 640x360 as 16.16 fixed point
+		binary.BigEndian.PutUint32(tkhd[76:80], 640<<16)
+		binary.BigEndian.PutUint32(tkhd[80:84], 360<<16)
+		entry = makeBox("avc1", make([]byte, 78), makeBox("avcC", []byte{1, 0x64, 0, 0x1f}))
+		mhd = makeBox("vmhd", be32(1), make([]byte, 8))
+	} else {
+		entry = makeBox("mp4a", make([]byte, 28))
+		mhd = makeBox("smhd", make([]byte, 8))
+	}
+	stsz := fullBox(0, n)
+	for _, size := range t.sizes {
+		stsz = append(stsz, be32(size)...)
+	}
+	// the last chunk holds the remaining samples
+	stsc := fullBox(1, 1, testChunkSize, 1)
+	if n%testChunkSize != 0 {
+		stsc = fullBox(2, 1, testChunkSize, 1, uint32(len(offsets)), n%testChunkSize, 1)
+	}
+	stbl := [][]byte{
+		makeBox("stsd", fullBox(1), entry),
+		makeBox("stts", fullBox(1, n, t.delta)),
+		makeBox("stsz", stsz),
+		makeBox("stsc", stsc),
+		makeBox("stco", fullBox(append([]uint32{uint32(len(offsets))}, offsets...)...)),
+	}
+	if t.sync != nil {
+		stbl = append(stbl, makeBox("stss", fullBox(append([]uint32{uint32(len(t.sync))}, t.sync...)...)))
+	}
+	hdlr := append(fullBox(0), t.handler...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	mdia := makeBox("mdia",
+		makeBox("mdhd", fullBox(0, 0, t.timescale, n*t.delta, 0)),
+		makeBox("hdlr", hdlr),
+		makeBox("minf", mhd, makeBox("stbl", stbl...)),
+	)
+	return makeBox("trak", makeBox("tkhd", tkhd), mdia)
+}
+
+// testVideo is a 30 fps video track of n frames with a keyframe every nth.
+func testVideo(n, nth int) testTrack {
+	t := testTrack{
+		handler:   "vide",
+		timescale: 15360,
+		delta:     512,
+		sizes:     make([]uint32, n),
+	}
+	if nth > 0 {
+		t.sync = everyNth(n, nth)
+	}
+	for i := range t.sizes {
+		// keyframes are bigger
+		t.sizes[i] = 20 + uint32(i%3)
+		if nth > 0 && i%nth == 0 {
+			t.sizes[i] = 50
+		}
+	}
+	return t
+}
+
+// testAudio is a 48 kHz AAC audio track of n samples.
+func testAudio(n int) testTrack {
+	return testTrack{
+		handler:   "soun",
+		timescale: 48000,
+		delta:     1024,
+		sizes:     uniformSizes(n, 6),
+	}
+}
+
+func TestReadBoxes(t *testing.T) {
+	large := append(be32(1), "free"...)
+	large = append(large, be64(20)...)
+	large = append(large, "abcd"...)
+	tests := []struct {
+		name string
+		data []byte
+		want []mp4Box
+	}{
+		{"empty", nil, nil},
+		{
+			name: "boxes",
+			data: append(makeBox("ftyp", []byte("isom")), makeBox("moov")...),
+			want: []mp4Box{{"ftyp", 8, 4}, {"moov", 20, 0}},
+		},
+		{
+			name: "largesize",
+			data: large,
+			want: []mp4Box{{"free", 16, 4}},
+		},
+		{
+			name: "size 0 extends to the end",
+			data: append(makeBox("ftyp"), append(be32(0), "mdat1234"...)...),
+			want: []mp4Box{{"ftyp", 8, 0}, {"mdat", 16, 4}},
+		},
+		{
+			name: "trailing bytes",
+			data: append(makeBox("ftyp"), 0, 0, 0),
+			want: []mp4Box{{"ftyp", 8, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBoxes(bytes.NewReader(tt.data), 0, int64(len(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadBoxesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"past the end", append(be32(16), "moov"...)},
+		{"smaller than header", append(be32(4), "moov"...)},
+		{"largesize smaller than header", append(append(be32(1), "moov"...), be64(8)...)},
+		{"truncated largesize", append(append(be32(1), "moov"...), 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readBoxes(bytes.NewReader(tt.data), 0, int64(len(tt.data)))
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+// stsdEntry returns an stsd payload with a sample entry of type typ holding
+// fields bytes of sample entry fields and the child boxes.
+func stsdEntry(typ string, fields int, children ...[]byte) []byte {
+	entry := makeBox(typ, append([][]byte{make([]byte, fields)}, children...)...)
+	return append(fullBox(1), entry...)
+}
+
+func TestParseStsd(t *testing.T) {
+	// ES_Descriptor > DecoderConfigDescriptor > DecoderSpecificInfo
+	dsi := []byte{5, 2, 0x12, 0x10}
+	dcd := append([]byte{4, 0x80, 0x80, 0x80, byte(13 + len(dsi)), 0x40, 0x15}, make([]byte, 11)...)
+	esd := append([]byte{3, byte(3 + len(dcd) + len(dsi)), 0, 1, 0}, append(dcd, dsi...)...)
+	esds := makeBox("esds", append(be32(0), esd...))
+	tests := []struct {
+		name string
+		stsd []byte
+		want string
+	}{
+		{"avc", stsdEntry("avc1", 78, makeBox("avcC", []byte{1, 0x64, 0, 0x28})), "avc1.640028"},
+		{"avc after other boxes", stsdEntry("avc3", 78, makeBox("pasp", be32(1), be32(1)), makeBox("avcC", []byte{1, 0x42, 0xc0, 0x1e})), "avc3.42c01e"},
+		{"avc without avcC", stsdEntry("avc1", 78), "avc1"},
+		{"aac", stsdEntry("mp4a", 28, esds), "mp4a.40.2"},
+		{"opus", stsdEntry("Opus", 28, makeBox("dOps", make([]byte, 11))), "opus"},
+		{"flac", stsdEntry("fLaC", 28), "flac"},
+		{"unknown", stsdEntry("xyz1", 8), "xyz1"},
+		{"short entry", stsdEntry("hvc1", 10), "hvc1"},
+		{"invalid child", stsdEntry("avc1", 78, append(be32(100), "avcC"...)), "avc1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStsd(tt.stsd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	for _, b := range [][]byte{nil, fullBox(1), append(fullBox(1), append(be32(100), "avc1"...)...)} {
+		_, err := parseStsd(b)
+		if err == nil {
+			t.Errorf("parseStsd(%v): got no error", b)
+		}
+	}
+}
+
+func TestParseMvhd(t *testing.T) {
+	v1 := append([]byte{1, 0, 0, 0}, be64(3600)...)
+	v1 = append(v1, be64(0)...)
+	v1 = append(v1, be32(1000)...)
+	v1 = append(v1, be64(90500)...)
+	tests := []struct {
+		name     string
+		mvhd     []byte
+		duration time.Duration
+		created  time.Time
+	}{
+		{"version 0", fullBox(60, 0, 600, 1500), 2500 * time.Millisecond, mp4Epoch.Add(time.Minute)},
+		{"version 1", v1, 90500 * time.Millisecond, mp4Epoch.Add(time.Hour)},
+		{"no timescale", fullBox(0, 0, 0, 1500), 0, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &MP4Info{}
+			err := info.parseMvhd(tt.mvhd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Duration != tt.duration || !info.Created.Equal(tt.created) {
+				t.Errorf("got %v and %v, want %v and %v", info.Duration, info.Created, tt.duration, tt.created)
+			}
+		})
+	}
+	err := (&MP4Info{}).parseMvhd(fullBox(0, 0, 600))
+	if err == nil {
+		t.Error("short mvhd: got no error")
+	}
+}
+
+func TestReadMP4Info(t *testing.T) {
+	tests := []struct {
+		name   string
+		tracks []testTrack
+		want   MP4Info
+	}{
+		{
+			name:   "video and audio",
+			tracks: []testTrack{testVideo(300, 45), testAudio(470)},
+			want: MP4Info{
+				Duration:   10026 * time.Millisecond,
+				Width:      640,
+				Height:     360,
+				VideoCodec: "avc1.64001f",
+				AudioCodec: "mp4a",
+			},
+		},
+		{
+			name:   "audio only",
+			tracks: []testTrack{testAudio(47)},
+			want:   MP4Info{Duration: 1002 * time.Millisecond, AudioCodec: "mp4a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := makeTestMP4(tt.tracks...)
+			info, err := ReadMP4Info(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *info != tt.want {
+				t.Errorf("got %+v, want %+v", *info, tt.want)
+			}
+		})
+	}
+	b := makeBox("ftyp", []byte("isom"))
+	_, err := ReadMP4Info(bytes.NewReader(b), int64(len(b)))
+	if err == nil {
+		t.Error("missing moov: got no error")
+	}
+}
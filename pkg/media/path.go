@@ -1,7 +1,51 @@
 package media
 
+// Modes for assigning IDs to videos.
+const (
+	// IDFilename uses the file name without extension (the default).
+	IDFilename = "filename"
+	// IDHash uses a hash of the file contents so IDs survive renaming.
+	IDHash = "hash"
+	// IDSidecar uses the id field of the sidecar (or the file name).
+	IDSidecar = "sidecar"
+)
+
+// Visibility levels of videos.
+const (
+	// Public videos are listed everywhere.
+	Public = "public"
+	// Unlisted videos are only reachable by a direct link.
+	Unlisted = "unlisted"
+	// Private videos are unlisted and require a password or token.
+	Private = "private"
+)
+
 // Path represents a media library path.
 type Path struct {
 	Path   string
 	Prefix string
+	IDMode string
+	// Visibility and Password are defaults for videos in the path
+	Visibility string
+	// Password isn't stored in the index (only a hash of it)
+	Password string `json:"-"`
+	// Storage holds the files of the path (the local filesystem when nil)
+	Storage Storage `json:"-"`
+}
+
+// storage returns the Storage of the path.
+func (p *Path) storage() Storage {
+	if p.Storage == nil {
+		return LocalStorage{}
+	}
+	return p.Storage
+}
+
+// settings returns a copy of the path without its Storage or Password for
+// comparing the settings that affect parsing.
+func (p *Path) settings() Path {
+	s := *p
+	s.Storage = nil
+	s.Password = ""
+	return s
 }
@@ -1,5 +1,10 @@
 package media
 
+import (
+	"sort"
+	"strings"
+)
+
 // Playlist holds an array of videos capable of sorting by Timestamp.
 type Playlist []*Video
 
@@ -17,3 +22,95 @@ func (p Playlist) Swap(i, j int) {
 func (p Playlist) Less(i, j int) bool {
 	return p[i].Timestamp.After(p[j].Timestamp)
 }
+
+// Episodes holds an array of videos capable of sorting by episode order.
+type Episodes Playlist
+
+// Len returns length of array (for sorting).
+func (e Episodes) Len() int {
+	return len(e)
+}
+
+// Swap swaps two values in array by index (for sorting).
+func (e Episodes) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+// Less returns true if e[i] comes before e[j] by Track then Title (for
+// sorting).
+func (e Episodes) Less(i, j int) bool {
+	if e[i].Track != e[j].Track {
+		return e[i].Track < e[j].Track
+	}
+	return e[i].Title < e[j].Title
+}
+
+// sortOrders maps the name of each sort order to its less function.
+var sortOrders = map[string]func(a, b *Video) bool{
+	"date": func(a, b *Video) bool {
+		return a.Timestamp.After(b.Timestamp)
+	},
+	"title": func(a, b *Video) bool {
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	},
+	"size": func(a, b *Video) bool {
+		return a.Size > b.Size
+	},
+	"duration": func(a, b *Video) bool {
+		return a.Duration > b.Duration
+	},
+	"album": func(a, b *Video) bool {
+		if a.Album != b.Album {
+			return strings.ToLower(a.Album) < strings.ToLower(b.Album)
+		}
+		return Episodes{a, b}.Less(0, 1)
+	},
+}
+
+// IsSortOrder returns true if order is the name of a sort order.
+func IsSortOrder(order string) bool {
+	_, ok := sortOrders[order]
+	return ok
+}
+
+// SortBy sorts the Playlist by a named order (date, title, size, duration or
+// album). Videos that are equal keep their existing order.
+func (p Playlist) SortBy(order string) {
+	less, ok := sortOrders[order]
+	if !ok {
+		return
+	}
+	sort.SliceStable(p, func(i, j int) bool {
+		return less(p[i], p[j])
+	})
+}
+
+// Sorted returns a copy of the Playlist sorted by a named order.
+func (p Playlist) Sorted(order string) Playlist {
+	pl := make(Playlist, len(p))
+	copy(pl, p)
+	pl.SortBy(order)
+	return pl
+}
+
+// Page returns page n (starting at 1) of the Playlist with size videos per
+// page.
+func (p Playlist) Page(n, size int) Playlist {
+	start := (n - 1) * size
+	if start < 0 || start >= len(p) {
+		return Playlist{}
+	}
+	end := start + size
+	if end > len(p) {
+		end = len(p)
+	}
+	return p[start:end]
+}
+
+// Pages returns the number of pages with size videos per page.
+func (p Playlist) Pages(size int) int {
+	if len(p) == 0 {
+		return 1
+	}
+	return (len(p) + size - 1) / size
+}
@@ -0,0 +1,58 @@
+package media
+
+import (
+	"os"
+	"time"
+)
+
+// Poller finds changes to the files inside of a directory by listing them
+// periodically. It's used for storages that can't be watched for changes.
+type Poller struct {
+	Storage Storage
+	Dir     string
+	files   map[string]pollState
+}
+
+// pollState is the state of a file when it was last polled.
+type pollState struct {
+	size    int64
+	modTime time.Time
+}
+
+// NewPoller returns a new Poller of dir in s.
+func NewPoller(s Storage, dir string) *Poller {
+	return &Poller{
+		Storage: s,
+		Dir:     dir,
+	}
+}
+
+// Poll lists the files again and returns those that were created or modified
+// and those that were removed since the last Poll. The first Poll only
+// records the files without reporting them.
+func (p *Poller) Poll() (changed, removed []string, err error) {
+	files := make(map[string]pollState, len(p.files))
+	err = p.Storage.Walk(p.Dir, func(name string, info os.FileInfo) error {
+		files[name] = pollState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.files != nil {
+		for name, s := range files {
+			old, ok := p.files[name]
+			if !ok || old.size != s.size || !old.modTime.Equal(s.modTime) {
+				changed = append(changed, name)
+			}
+		}
+		for name := range p.files {
+			_, ok := files[name]
+			if !ok {
+				removed = append(removed, name)
+			}
+		}
+	}
+	p.files = files
+	return changed, removed, nil
+}
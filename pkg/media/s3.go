@@ -0,0 +1,450 @@
+package media
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyHash is the SHA-256 hash of an empty request body.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3RequestTimeout limits list and stat requests, including reading their
+// response. Object data is streamed so reading it has no overall limit.
+const s3RequestTimeout = 30 * time.Second
+
+// s3Client sends the requests of an S3Storage without a Client. Only
+// connecting and waiting for the response headers time out so long streams
+// of object data aren't cut off.
+var s3Client = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	},
+}
+
+// s3SkipLimit is the most bytes read and discarded to seek forward in an
+// open response instead of requesting a new range.
+const s3SkipLimit = 64 << 10
+
+// S3Storage is a Storage of an S3-compatible object store (such as MinIO).
+// Names inside of Root map to the keys below Prefix in Bucket. Requests use
+// path-style URLs signed with AWS Signature Version 4.
+type S3Storage struct {
+	// Root is the library path the bucket is mounted at
+	Root string
+	// Endpoint is the URL of the server (such as http://localhost:9000)
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Client sends the requests (a client with connection and response
+	// header timeouts when nil)
+	Client *http.Client
+}
+
+// s3ListResult is the response of ListObjectsV2.
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+}
+
+// s3Error is the error response of S3 requests.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// key returns the object key of a name.
+func (s *S3Storage) key(name string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, s.Root), "/")
+	return strings.TrimPrefix(path.Join(strings.Trim(s.Prefix, "/"), rel), "/")
+}
+
+// name returns the name of an object key.
+func (s *S3Storage) name(key string) string {
+	rel := strings.TrimPrefix(key, strings.Trim(s.Prefix, "/"))
+	return path.Join(s.Root, strings.TrimPrefix(rel, "/"))
+}
+
+// Walk calls fn for every object below dir.
+func (s *S3Storage) Walk(dir string, fn WalkFunc) error {
+	return s.list(dir, "", func(key string, info os.FileInfo) error {
+		return fn(s.name(key), info)
+	})
+}
+
+// ReadDir returns the names of the objects directly in dir.
+func (s *S3Storage) ReadDir(dir string) ([]string, error) {
+	var names []string
+	err := s.list(dir, "/", func(key string, info os.FileInfo) error {
+		names = append(names, path.Base(key))
+		return nil
+	})
+	return names, err
+}
+
+// list calls fn for the objects below dir (only those directly in it when
+// delimiter is "/").
+func (s *S3Storage) list(dir, delimiter string, fn func(key string, info os.FileInfo) error) error {
+	prefix := s.key(dir)
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("prefix", prefix)
+	if len(delimiter) > 0 {
+		q.Set("delimiter", delimiter)
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+		res, err := s.do(ctx, "GET", "", q, nil)
+		if err != nil {
+			cancel()
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, c := range result.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				// folder placeholder
+				continue
+			}
+			info := &s3FileInfo{
+				name:    path.Base(c.Key),
+				size:    c.Size,
+				modTime: c.LastModified,
+			}
+			err = fn(c.Key, info)
+			if err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		q.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Stat returns the attributes of an object.
+func (s *S3Storage) Stat(name string) (os.FileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+	res, err := s.do(ctx, "HEAD", s.key(name), nil, nil)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	res.Body.Close()
+	return s.fileInfo(name, res)
+}
+
+// fileInfo returns the attributes of an object from a response.
+func (s *S3Storage) fileInfo(name string, res *http.Response) (os.FileInfo, error) {
+	info := &s3FileInfo{name: path.Base(name)}
+	size := res.Header.Get("Content-Length")
+	if cr := res.Header.Get("Content-Range"); len(cr) > 0 {
+		// bytes start-end/size
+		size = cr[strings.LastIndex(cr, "/")+1:]
+	}
+	var err error
+	info.size, err = strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return nil, errors.New("media: invalid object size")
+	}
+	info.modTime, err = http.ParseTime(res.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil, errors.New("media: invalid object modification time")
+	}
+	return info, nil
+}
+
+// Open opens an object for reading. Data is requested in ranges as it's
+// read.
+func (s *S3Storage) Open(name string) (File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, key: s.key(name), info: info}, nil
+}
+
+// do sends a signed request for an object key (the bucket when empty) that's
+// canceled with ctx.
+func (s *S3Storage) do(ctx context.Context, method, key string, q url.Values, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.Bucket
+	if len(key) > 0 {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(q)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = s3Client
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	var e s3Error
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if xml.Unmarshal(b, &e) == nil && len(e.Code) > 0 {
+		return nil, fmt.Errorf("media: s3: %s: %s", e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("media: s3: %s", res.Status)
+}
+
+// sign adds AWS Signature Version 4 headers to a request.
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", emptyHash)
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + emptyHash,
+		"x-amz-date:" + stamp,
+		"",
+		signed,
+		emptyHash,
+	}, "\n")
+	region := s.Region
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+	scope := date + "/" + region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, sig,
+	))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape URI encodes a string as required by Signature Version 4 (keeping
+// slashes unless encodeSlash is set).
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case c == '-' || c == '_' || c == '.' || c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical query string of q (sorted by key).
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3FileInfo is the os.FileInfo of an object.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) Mode() os.FileMode  { return 0444 }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return false }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+
+// s3File reads an object using range requests. Sequential reads share one
+// response while ReadAt requests exactly the range asked for.
+type s3File struct {
+	s      *S3Storage
+	key    string
+	info   os.FileInfo
+	offset int64
+	// body is the open response starting at bodyOffset (nil if none)
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+// Read reads from the current offset, requesting the rest of the object if
+// there's no response open at that offset.
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body != nil && f.offset > f.bodyOffset && f.offset-f.bodyOffset <= s3SkipLimit {
+		// skip ahead instead of starting a new request
+		n, err := io.CopyN(ioutil.Discard, f.body, f.offset-f.bodyOffset)
+		f.bodyOffset += n
+		if err != nil {
+			f.closeBody()
+		}
+	}
+	if f.body != nil && f.bodyOffset != f.offset {
+		f.closeBody()
+	}
+	if f.body == nil {
+		h := http.Header{}
+		h.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		res, err := f.s.do(context.Background(), "GET", f.key, nil, h)
+		if err != nil {
+			return 0, err
+		}
+		f.body = res.Body
+		f.bodyOffset = f.offset
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	f.bodyOffset += int64(n)
+	if err == io.EOF {
+		f.closeBody()
+		if n > 0 {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at offset off.
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.Size() {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > f.info.Size() {
+		end = f.info.Size()
+	}
+	h := http.Header{}
+	h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end-1))
+	res, err := f.s.do(context.Background(), "GET", f.key, nil, h)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	n, err := io.ReadFull(res.Body, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read.
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("media: negative seek offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Stat returns the attributes of the object.
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Close closes any open response.
+func (f *s3File) Close() error {
+	f.closeBody()
+	return nil
+}
+
+// closeBody closes the open response.
+func (f *s3File) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+}
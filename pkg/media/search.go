@@ -0,0 +1,226 @@
+package media
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Search weights per field so that title matches rank above others.
+const (
+	titleWeight       = 4
+	albumWeight       = 2
+	tagWeight         = 2
+	descriptionWeight = 1
+)
+
+// searchIndex is an in-memory inverted index of the text fields of videos.
+type searchIndex struct {
+	mu sync.RWMutex
+	// terms maps each term to the IDs of videos containing it and a score
+	terms map[string]map[string]int
+	// docs maps video IDs to their terms (for removal)
+	docs map[string][]string
+	// sorted holds every term in order for prefix matching (nil when stale)
+	sorted []string
+}
+
+// Query is a parsed search query.
+type Query struct {
+	Terms  []string
+	Album  string
+	Prefix string
+}
+
+// newSearchIndex returns a new empty searchIndex.
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		terms: make(map[string]map[string]int),
+		docs:  make(map[string][]string),
+	}
+}
+
+// tokenize splits text into lowercase words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// add indexes the text fields of a video (replacing any previous entry).
+func (s *searchIndex) add(v *Video) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unindex(v.ID)
+	scores := make(map[string]int)
+	for _, t := range tokenize(v.Title) {
+		scores[t] += titleWeight
+	}
+	for _, t := range tokenize(v.Album) {
+		scores[t] += albumWeight
+	}
+	for _, tag := range v.Tags {
+		for _, t := range tokenize(tag) {
+			scores[t] += tagWeight
+		}
+	}
+	for _, t := range tokenize(v.Description) {
+		scores[t] += descriptionWeight
+	}
+	terms := make([]string, 0, len(scores))
+	for t, score := range scores {
+		ids, ok := s.terms[t]
+		if !ok {
+			ids = make(map[string]int)
+			s.terms[t] = ids
+			s.sorted = nil
+		}
+		ids[v.ID] = score
+		terms = append(terms, t)
+	}
+	s.docs[v.ID] = terms
+}
+
+// remove removes a video from the index by ID.
+func (s *searchIndex) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unindex(id)
+}
+
+// unindex removes a video from the index (s.mu must be held).
+func (s *searchIndex) unindex(id string) {
+	for _, t := range s.docs[id] {
+		ids := s.terms[t]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(s.terms, t)
+			s.sorted = nil
+		}
+	}
+	delete(s.docs, id)
+}
+
+// match returns the IDs of videos with every query term as the prefix of one
+// of their words, along with their scores.
+func (s *searchIndex) match(terms []string) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sorted == nil {
+		s.sorted = make([]string, 0, len(s.terms))
+		for t := range s.terms {
+			s.sorted = append(s.sorted, t)
+		}
+		sort.Strings(s.sorted)
+	}
+	var results map[string]int
+	for _, qt := range terms {
+		scores := make(map[string]int)
+		i := sort.SearchStrings(s.sorted, qt)
+		for ; i < len(s.sorted) && strings.HasPrefix(s.sorted[i], qt); i++ {
+			t := s.sorted[i]
+			weight := s.terms[t]
+			for id, score := range weight {
+				// exact matches rank above prefix matches
+				if t == qt {
+					score *= 2
+				}
+				if score > scores[id] {
+					scores[id] = score
+				}
+			}
+		}
+		if results == nil {
+			results = scores
+			continue
+		}
+		// every term has to match
+		for id, score := range results {
+			n, ok := scores[id]
+			if ok {
+				results[id] = score + n
+			} else {
+				delete(results, id)
+			}
+		}
+	}
+	return results
+}
+
+// ParseQuery parses a search query of words and the filters album:name and
+// prefix:name. Filter values may be quoted to include spaces.
+func ParseQuery(q string) *Query {
+	query := &Query{}
+	for _, field := range splitQuery(q) {
+		switch {
+		case strings.HasPrefix(field, "album:"):
+			query.Album = strings.TrimPrefix(field, "album:")
+		case strings.HasPrefix(field, "prefix:"):
+			query.Prefix = strings.TrimPrefix(field, "prefix:")
+		default:
+			query.Terms = append(query.Terms, tokenize(field)...)
+		}
+	}
+	return query
+}
+
+// splitQuery splits a query by spaces except those within quotes.
+func splitQuery(q string) []string {
+	var fields []string
+	var b strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if b.Len() > 0 {
+				fields = append(fields, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		fields = append(fields, b.String())
+	}
+	return fields
+}
+
+// Matches returns true if a video passes the filters of the query.
+func (q *Query) Matches(v *Video) bool {
+	if len(q.Album) > 0 && !strings.EqualFold(v.Album, q.Album) {
+		return false
+	}
+	if len(q.Prefix) > 0 {
+		prefix := strings.Trim(q.Prefix, "/") + "/"
+		if !strings.HasPrefix(v.ID, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchesAll returns true if a video passes the filters of the query and has
+// every query term as the prefix of one of its words (as in a search).
+func (q *Query) MatchesAll(v *Video) bool {
+	if !q.Matches(v) {
+		return false
+	}
+	words := tokenize(v.Title + " " + v.Album + " " + strings.Join(v.Tags, " ") + " " + v.Description)
+	for _, qt := range q.Terms {
+		found := false
+		for _, w := range words {
+			if strings.HasPrefix(w, qt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package media
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want Query
+	}{
+		{"", Query{}},
+		{"   ", Query{}},
+		{"cats", Query{Terms: []string{"cats"}}},
+		{"Funny  CATS", Query{Terms: []string{"funny", "cats"}}},
+		{"cat's-cradle", Query{Terms: []string{"cat", "s", "cradle"}}},
+		{"café 2019", Query{Terms: []string{"café", "2019"}}},
+		{"album:Travel", Query{Album: "Travel"}},
+		{`album:"Road Trip" sunset`, Query{Terms: []string{"sunset"}, Album: "Road Trip"}},
+		{`"album:Road Trip"`, Query{Album: "Road Trip"}},
+		{"prefix:pre/2019 beach", Query{Terms: []string{"beach"}, Prefix: "pre/2019"}},
+		{"album: prefix:", Query{}},
+		{"album:a album:b", Query{Album: "b"}},
+		{`"new york" city`, Query{Terms: []string{"new", "york", "city"}}},
+		{`"unterminated quote`, Query{Terms: []string{"unterminated", "quote"}}},
+		{"!!! ???", Query{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			got := ParseQuery(tt.q)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.q, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	v := &Video{ID: "pre/2019/beach", Album: "Road Trip"}
+	tests := []struct {
+		q    string
+		want bool
+	}{
+		{"anything", true},
+		{`album:"road trip"`, true},
+		{"album:Travel", false},
+		{"prefix:pre", true},
+		{"prefix:/pre/2019/", true},
+		{"prefix:pre/20", false},
+		{"prefix:other", false},
+		{`album:"Road Trip" prefix:pre/2019`, true},
+		{`album:"Road Trip" prefix:other`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			got := ParseQuery(tt.q).Matches(v)
+			if got != tt.want {
+				t.Errorf("Matches(%q) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchIndexMatch(t *testing.T) {
+	s := newSearchIndex()
+	s.add(&Video{ID: "a", Title: "Sunset at the beach", Tags: []string{"summer"}})
+	s.add(&Video{ID: "b", Title: "Beach volleyball", Description: "sunny day"})
+	s.add(&Video{ID: "c", Title: "Mountains", Album: "Sunset"})
+	tests := []struct {
+		q    string
+		want map[string]int
+	}{
+		{"beach", map[string]int{"a": 8, "b": 8}},
+		{"sun", map[string]int{"a": 4, "b": 1, "c": 2}},
+		{"sunset", map[string]int{"a": 8, "c": 4}},
+		{"sunset beach", map[string]int{"a": 16}},
+		{"summer", map[string]int{"a": 4}},
+		{"snow", map[string]int{}},
+		{"beach snow", map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			got := s.match(ParseQuery(tt.q).Terms)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("match(%q) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+	// removed videos no longer match
+	s.remove("a")
+	got := s.match([]string{"sunset"})
+	want := map[string]int{"c": 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("match after remove = %v, want %v", got, want)
+	}
+}
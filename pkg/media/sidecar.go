@@ -0,0 +1,156 @@
+package media
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Sidecar holds metadata from a JSON file stored beside a video (name.json
+// for name.mp4) which overrides or adds to the metadata embedded in the video.
+// Empty fields leave the embedded values unchanged.
+type Sidecar struct {
+	// ID is only used by paths with the sidecar ID mode
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Album       string   `json:"album"`
+	Track       int      `json:"track"`
+	Published   string   `json:"published"`
+	Tags        []string `json:"tags"`
+	Thumbnail   string   `json:"thumbnail"`
+	Visibility  string   `json:"visibility"`
+	Password    string   `json:"password"`
+}
+
+// sidecar date formats, tried in order
+var dateFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// sidecarPath returns the path of the sidecar file for a video path.
+func sidecarPath(fp string) string {
+	return strings.TrimSuffix(fp, path.Ext(fp)) + ".json"
+}
+
+// readSidecar reads the sidecar for video path fp from st. A missing sidecar
+// returns nil without an error.
+func readSidecar(st Storage, fp string) (*Sidecar, error) {
+	b, err := readFile(st, sidecarPath(fp))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := &Sidecar{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply overrides the fields of v with those set in the sidecar (reading any
+// thumbnail from st inside of library path root).
+func (s *Sidecar) apply(st Storage, root string, v *Video) error {
+	if len(s.Title) > 0 {
+		v.Title = s.Title
+	}
+	if len(s.Description) > 0 {
+		v.Description = s.Description
+	}
+	if len(s.Album) > 0 {
+		v.Album = s.Album
+	}
+	if s.Track > 0 {
+		v.Track = s.Track
+	}
+	if len(s.Tags) > 0 {
+		v.Tags = s.Tags
+	}
+	var err error
+	switch s.Visibility {
+	case "":
+		// a password makes the video private unless set otherwise
+		if len(s.Password) > 0 {
+			v.Visibility = Private
+		}
+	case Public, Unlisted, Private:
+		v.Visibility = s.Visibility
+	default:
+		// hide the video rather than exposing it because of a typo
+		v.Visibility = Private
+		err = errors.New("media: invalid visibility " + s.Visibility)
+	}
+	if len(s.Password) > 0 {
+		v.Password = s.Password
+	}
+	if len(s.Published) > 0 {
+		t, err := parseDate(s.Published)
+		if err != nil {
+			return err
+		}
+		v.Timestamp = t
+		v.Published = t
+		v.Modified = t.Format("2006-01-02 03:04 PM")
+	}
+	if len(s.Thumbnail) > 0 {
+		// thumbnail path is relative to the video and can't leave the
+		// library path (it's served to anyone who can see the video)
+		if path.IsAbs(s.Thumbnail) {
+			return errors.New("media: thumbnail path must be relative")
+		}
+		tp := path.Join(path.Dir(v.Path), s.Thumbnail)
+		if !insideDir(tp, root) {
+			return errors.New("media: thumbnail outside of library path")
+		}
+		b, err := readFile(st, tp)
+		if err != nil {
+			return err
+		}
+		v.setThumb(tp, mime.TypeByExtension(path.Ext(tp)), b)
+		v.Related = append(v.Related, tp)
+	}
+	return err
+}
+
+// insideDir returns true if slash separated path fp is nested inside of dir.
+func insideDir(fp, dir string) bool {
+	fp = path.Clean(fp)
+	dir = path.Clean(dir)
+	if dir == "." {
+		return !path.IsAbs(fp) && fp != ".." && !strings.HasPrefix(fp, "../")
+	}
+	return strings.HasPrefix(fp, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// validID returns true if a sidecar ID is a clean relative path that stays
+// inside of the prefix of its library path.
+func validID(id string) bool {
+	if len(id) == 0 || path.IsAbs(id) || path.Clean(id) != id {
+		return false
+	}
+	for _, part := range strings.Split(id, "/") {
+		if part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDate parses a sidecar date in any of the supported formats.
+func parseDate(s string) (time.Time, error) {
+	for _, f := range dateFormats {
+		t, err := time.ParseInLocation(f, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("media: invalid date " + s)
+}
@@ -0,0 +1,29 @@
+package media
+
+import "testing"
+
+func TestValidID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"intro", true},
+		{"2019/intro", true},
+		{"intro.v2", true},
+		{"", false},
+		{"/intro", false},
+		{"../other/intro", false},
+		{"2019/../../intro", false},
+		{"..", false},
+		{".", false},
+		{"./intro", false},
+		{"2019//intro", false},
+		{"intro/", false},
+	}
+	for _, tt := range tests {
+		got := validID(tt.id)
+		if got != tt.want {
+			t.Errorf("validID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
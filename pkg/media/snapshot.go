@@ -0,0 +1,159 @@
+package media
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is an immutable view of the Library published after each batch of
+// changes so it can be read without locking. Nothing in a Snapshot may be
+// modified.
+type Snapshot struct {
+	// Version increases every time a Snapshot is published
+	Version int64
+	// Base is the Version the library started from, changes made before it
+	// aren't known
+	Base    int64
+	Created time.Time
+	// Videos holds every video by ID (including unlisted ones)
+	Videos map[string]*Video
+	// Redirects maps the old IDs of moved videos to their current ID
+	Redirects map[string]string
+	// Albums holds the listed episodes of each album
+	Albums map[string]Playlist
+	// Prefixes holds the listed videos of each library path prefix (without
+	// surrounding slashes)
+	Prefixes map[string]Playlist
+	// Changes maps the ID of every video changed since Base to the Version it
+	// was last added, updated or removed in
+	Changes map[string]int64
+	// sorted holds the listed videos in each sort order
+	sorted map[string]Playlist
+	// listed holds the listed state of changed videos from each version they
+	// were changed in
+	listed map[string][]listing
+}
+
+// listing is the state of a video from the version it was changed in: the
+// video if it was listed or nil if it was removed or not listed.
+type listing struct {
+	Version int64
+	Video   *Video
+}
+
+// newSnapshot builds a Snapshot of the library (lib.mu must be held).
+func newSnapshot(lib *Library, version int64) *Snapshot {
+	s := &Snapshot{
+		Version:   version,
+		Base:      lib.base,
+		Created:   time.Now(),
+		Videos:    make(map[string]*Video, len(lib.Videos)),
+		Redirects: make(map[string]string, len(lib.Redirects)),
+		Albums:    make(map[string]Playlist),
+		Prefixes:  make(map[string]Playlist),
+		Changes:   make(map[string]int64, len(lib.changes)),
+		sorted:    make(map[string]Playlist, len(sortOrders)),
+		listed:    make(map[string][]listing, len(lib.listed)),
+	}
+	for id, version := range lib.changes {
+		s.Changes[id] = version
+	}
+	for id, l := range lib.listed {
+		s.listed[id] = l
+	}
+	for from, to := range lib.Redirects {
+		s.Redirects[from] = to
+	}
+	pl := make(Playlist, 0, len(lib.Videos))
+	for id, v := range lib.Videos {
+		s.Videos[id] = v
+		if v.Listed() {
+			pl = append(pl, v)
+		}
+	}
+	sort.Sort(pl)
+	for order := range sortOrders {
+		s.sorted[order] = pl.Sorted(order)
+	}
+	for _, v := range pl {
+		if len(v.Album) > 0 {
+			s.Albums[v.Album] = append(s.Albums[v.Album], v)
+		}
+		p, _, ok := lib.lookupPath(v.Path)
+		if ok {
+			prefix := strings.Trim(p.Prefix, "/")
+			s.Prefixes[prefix] = append(s.Prefixes[prefix], v)
+		}
+	}
+	for _, episodes := range s.Albums {
+		sort.Sort(Episodes(episodes))
+	}
+	return s
+}
+
+// Playlist returns the listed videos sorted newest first.
+func (s *Snapshot) Playlist() Playlist {
+	return s.sorted["date"]
+}
+
+// Sorted returns the listed videos sorted by a named order (see SortBy).
+func (s *Snapshot) Sorted(order string) Playlist {
+	pl, ok := s.sorted[order]
+	if !ok {
+		return s.Playlist()
+	}
+	return pl
+}
+
+// Video returns a video by ID.
+func (s *Snapshot) Video(id string) (*Video, bool) {
+	v, ok := s.Videos[id]
+	return v, ok
+}
+
+// ChangedSince returns the videos of pl changed after version along with the
+// IDs of videos no longer part of pl which were listed at version and matched
+// by match (the filters pl was built with). Videos that were never visible
+// in the view aren't reported.
+func (s *Snapshot) ChangedSince(pl Playlist, version int64, match func(*Video) bool) (Playlist, []string) {
+	changed := Playlist{}
+	in := make(map[string]bool, len(pl))
+	for _, v := range pl {
+		in[v.ID] = true
+		if s.Changes[v.ID] > version {
+			changed = append(changed, v)
+		}
+	}
+	removed := []string{}
+	for id, cv := range s.Changes {
+		if cv <= version || in[id] {
+			continue
+		}
+		old := s.listedAt(id, version)
+		if old != nil && match(old) {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
+}
+
+// listedAt returns the video with an ID as it was listed at version (nil if
+// it wasn't listed then).
+func (s *Snapshot) listedAt(id string, version int64) *Video {
+	var v *Video
+	for _, l := range s.listed[id] {
+		if l.Version > version {
+			break
+		}
+		v = l.Video
+	}
+	return v
+}
+
+// Redirect returns the current ID of a video that was moved from id.
+func (s *Snapshot) Redirect(id string) (string, bool) {
+	to, ok := s.Redirects[id]
+	return to, ok
+}
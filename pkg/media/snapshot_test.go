@@ -0,0 +1,81 @@
+package media
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangedSince(t *testing.T) {
+	lib := NewLibrary()
+	update := func(vs ...*Video) int64 {
+		lib.mu.Lock()
+		for _, v := range vs {
+			err := lib.insert(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		lib.mu.Unlock()
+		return lib.Publish().Version
+	}
+	remove := func(id string) {
+		lib.mu.Lock()
+		lib.remove(lib.Videos[id])
+		lib.mu.Unlock()
+		lib.Publish()
+	}
+	since := update(
+		&Video{ID: "pre/a", Path: "a", Hash: "a", Album: "Travel"},
+		&Video{ID: "pre/b", Path: "b", Hash: "b", Album: "Cats"},
+		&Video{ID: "pre/c", Path: "c", Hash: "c", Visibility: Unlisted},
+		&Video{ID: "pre/d", Path: "d", Hash: "d", Album: "Travel", Title: "Beach"},
+	)
+	// changed after since
+	update(&Video{ID: "pre/d", Path: "d", Hash: "d", Album: "Cats", Title: "Beach"})
+	update(&Video{ID: "pre/e", Path: "e", Hash: "e", Visibility: Private})
+	update(&Video{ID: "pre/f", Path: "f", Hash: "f", Album: "Travel"})
+	update(&Video{ID: "pre/c", Path: "c", Hash: "c", Visibility: Unlisted, Title: "Secret"})
+	update(&Video{ID: "pre/b", Path: "b", Hash: "b", Album: "Cats", Visibility: Unlisted})
+	remove("pre/a")
+	remove("pre/e")
+	remove("pre/f")
+	snap := lib.Snapshot()
+	all := func(*Video) bool { return true }
+	travel := func(v *Video) bool { return v.Album == "Travel" }
+	cats := func(v *Video) bool { return v.Album == "Cats" }
+	beach := ParseQuery("beach").MatchesAll
+	tests := []struct {
+		name    string
+		match   func(*Video) bool
+		changed []string
+		removed []string
+	}{
+		// unlisted, private and never listed videos aren't reported
+		{"all", all, []string{"pre/d"}, []string{"pre/a", "pre/b"}},
+		// videos outside of the view at since aren't reported
+		{"album", travel, nil, []string{"pre/a", "pre/d"}},
+		{"other album", cats, []string{"pre/d"}, []string{"pre/b"}},
+		{"search", beach, []string{"pre/d"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pl Playlist
+			for _, v := range snap.Playlist() {
+				if tt.match(v) {
+					pl = append(pl, v)
+				}
+			}
+			changed, removed := snap.ChangedSince(pl, since, tt.match)
+			var ids []string
+			for _, v := range changed {
+				ids = append(ids, v.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.changed) {
+				t.Errorf("got changed %v, want %v", ids, tt.changed)
+			}
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Errorf("got removed %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
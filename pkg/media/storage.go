@@ -0,0 +1,96 @@
+package media
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Storage provides access to the files of library paths. Names are slash
+// separated and include the library path (as in Video.Path).
+type Storage interface {
+	// Walk calls fn for every file nested inside of dir.
+	Walk(dir string, fn WalkFunc) error
+	// ReadDir returns the names of the files in dir.
+	ReadDir(dir string) ([]string, error)
+	// Stat returns the attributes of a file. Missing files result in an
+	// error satisfying os.IsNotExist.
+	Stat(name string) (os.FileInfo, error)
+	// Open opens a file for reading.
+	Open(name string) (File, error)
+}
+
+// WalkFunc is called by Storage.Walk for each file.
+type WalkFunc func(name string, info os.FileInfo) error
+
+// File is a file opened from a Storage. Reading at arbitrary offsets is
+// supported so ranges can be served without reading the whole file.
+type File interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// LocalStorage is a Storage of the local filesystem.
+type LocalStorage struct{}
+
+// Walk calls fn for every file nested inside of dir. Subdirectories that
+// can't be read are logged and skipped.
+func (LocalStorage) Walk(dir string, fn WalkFunc) error {
+	return filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			if fp == dir {
+				return err
+			}
+			log.Println("Walk error:", err)
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(filepath.ToSlash(fp), info)
+	})
+}
+
+// ReadDir returns the names of the files in dir.
+func (LocalStorage) ReadDir(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// Stat returns the attributes of a file.
+func (LocalStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Open opens a file for reading.
+func (LocalStorage) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+// readFile reads a whole file from s.
+func readFile(s Storage, name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// modTime returns the modification time of a file (zero if it doesn't exist).
+func modTime(s Storage, fp string) time.Time {
+	info, err := s.Stat(fp)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
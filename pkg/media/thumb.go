@@ -0,0 +1,334 @@
+package media
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dhowden/tag"
+
+	// register PNG decoder for cover art
+	_ "image/png"
+)
+
+// ThumbWidths are the widths (in pixels) thumbnails are resized to.
+var ThumbWidths = []int{160, 320, 640}
+
+// thumbExts are the extensions of images used as thumbnails.
+var thumbExts = []string{".jpg", ".jpeg", ".png"}
+
+// folderThumbs are the names (without extension) of images used as the
+// thumbnail of every video in their directory, in order of priority.
+var folderThumbs = []string{"folder", "cover"}
+
+// thumbQuality is the JPEG quality of resized thumbnails.
+const thumbQuality = 85
+
+// ThumbCache loads thumbnails on demand and keeps the most recently used in
+// memory (up to a limit). Resized thumbnails are stored on disk so each size
+// only needs to be created once.
+type ThumbCache struct {
+	mu sync.Mutex
+	// Dir is where resized thumbnails are stored (disabled when empty)
+	Dir string
+	// MaxMemory is the maximum bytes of thumbnails kept in memory
+	MaxMemory int
+	size      int
+	lru       *list.List
+	items     map[string]*list.Element
+}
+
+// thumbEntry is a thumbnail kept in memory by ThumbCache.
+type thumbEntry struct {
+	key  string
+	data []byte
+	typ  string
+}
+
+// NewThumbCache returns a ThumbCache storing thumbnails in dir and keeping
+// up to maxMemory bytes of them in memory.
+func NewThumbCache(dir string, maxMemory int) (*ThumbCache, error) {
+	if len(dir) > 0 {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &ThumbCache{
+		Dir:       dir,
+		MaxMemory: maxMemory,
+		lru:       list.New(),
+		items:     make(map[string]*list.Element),
+	}
+	return c, nil
+}
+
+// thumbHash returns a short hash identifying thumbnail data.
+func thumbHash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:6])
+}
+
+// ThumbWidth returns the smallest thumbnail width at least w wide (or the
+// largest width available).
+func ThumbWidth(w int) int {
+	for _, tw := range ThumbWidths {
+		if tw >= w {
+			return tw
+		}
+	}
+	return ThumbWidths[len(ThumbWidths)-1]
+}
+
+// Get returns the thumbnail of v (read from s) resized to width w (one of
+// ThumbWidths, or 0 for the original) along with its MIME type. Thumbnails
+// narrower than w are returned unchanged.
+func (c *ThumbCache) Get(s Storage, v *Video, w int) ([]byte, string, error) {
+	if len(v.ThumbPath) == 0 {
+		return nil, "", fmt.Errorf("media: no thumbnail for %s", v.ID)
+	}
+	key := fmt.Sprintf("%s-%d", v.ThumbHash, w)
+	data, typ, ok := c.get(key)
+	if ok {
+		return data, typ, nil
+	}
+	if w == 0 {
+		data, typ, err := loadThumb(s, v)
+		if err != nil {
+			return nil, "", err
+		}
+		c.put(key, data, typ)
+		return data, typ, nil
+	}
+	var fp string
+	if len(c.Dir) > 0 {
+		fp = filepath.Join(c.Dir, key+".jpg")
+		b, err := ioutil.ReadFile(fp)
+		if err == nil {
+			c.put(key, b, "image/jpeg")
+			return b, "image/jpeg", nil
+		}
+	}
+	orig, typ, err := c.Get(s, v, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(bytes.NewReader(orig))
+	if err != nil {
+		return nil, "", err
+	}
+	if src.Bounds().Dx() <= w {
+		return orig, typ, nil
+	}
+	buf := &bytes.Buffer{}
+	err = jpeg.Encode(buf, resize(src, w), &jpeg.Options{Quality: thumbQuality})
+	if err != nil {
+		return nil, "", err
+	}
+	b := buf.Bytes()
+	if len(fp) > 0 {
+		err = writeFile(fp, b)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	c.put(key, b, "image/jpeg")
+	return b, "image/jpeg", nil
+}
+
+// get returns a thumbnail from memory and marks it as recently used.
+func (c *ThumbCache) get(key string) ([]byte, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, "", false
+	}
+	c.lru.MoveToFront(el)
+	e := el.Value.(*thumbEntry)
+	return e.data, e.typ, true
+}
+
+// put adds a thumbnail to memory, evicting the least recently used ones to
+// stay under MaxMemory.
+func (c *ThumbCache) put(key string, data []byte, typ string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(data) > c.MaxMemory {
+		return
+	}
+	_, ok := c.items[key]
+	if ok {
+		return
+	}
+	c.items[key] = c.lru.PushFront(&thumbEntry{key: key, data: data, typ: typ})
+	c.size += len(data)
+	for c.size > c.MaxMemory {
+		el := c.lru.Back()
+		e := el.Value.(*thumbEntry)
+		c.lru.Remove(el)
+		delete(c.items, e.key)
+		c.size -= len(e.data)
+	}
+}
+
+// Evict removes the thumbnails with a given hash from memory and disk.
+func (c *ThumbCache) Evict(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range append([]int{0}, ThumbWidths...) {
+		key := fmt.Sprintf("%s-%d", hash, w)
+		el, ok := c.items[key]
+		if ok {
+			c.lru.Remove(el)
+			delete(c.items, key)
+			c.size -= len(el.Value.(*thumbEntry).data)
+		}
+		if w > 0 && len(c.Dir) > 0 {
+			os.Remove(filepath.Join(c.Dir, key+".jpg"))
+		}
+	}
+}
+
+// findThumb returns the path of an image to use as thumbnail for video path
+// fp (empty if there is none) from the names of the files in its directory.
+// Images sharing the name of the video (name.jpg) take priority over folder
+// images (folder.jpg then cover.jpg). Names are matched case insensitively.
+func findThumb(fp string, names []string) string {
+	lower := make(map[string]string, len(names))
+	for _, n := range names {
+		lower[strings.ToLower(n)] = n
+	}
+	base := strings.TrimSuffix(path.Base(fp), path.Ext(fp))
+	for _, b := range append([]string{base}, folderThumbs...) {
+		for _, ext := range thumbExts {
+			n, ok := lower[strings.ToLower(b+ext)]
+			if ok {
+				return path.Join(path.Dir(fp), n)
+			}
+		}
+	}
+	return ""
+}
+
+// isFolderThumb returns true if a file name is one of the folder images.
+func isFolderThumb(name string) bool {
+	name = strings.ToLower(name)
+	for _, b := range folderThumbs {
+		for _, ext := range thumbExts {
+			if name == b+ext {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadThumb reads the original thumbnail of v from its file in s.
+func loadThumb(s Storage, v *Video) ([]byte, string, error) {
+	if v.ThumbPath != v.Path {
+		b, err := readFile(s, v.ThumbPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return b, v.ThumbType, nil
+	}
+	// embedded picture
+	f, err := s.Open(v.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, "", err
+	}
+	pic := m.Picture()
+	if pic == nil {
+		return nil, "", fmt.Errorf("media: no thumbnail for %s", v.ID)
+	}
+	return pic.Data, pic.MIMEType, nil
+}
+
+// writeFile writes data to a temporary file before renaming it to fp so
+// readers never see a partial file.
+func writeFile(fp string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fp), ".tmp")
+	if err != nil {
+		return err
+	}
+	// TempFile creates files only readable by owner
+	tmp.Chmod(0644)
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), fp)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// resize scales src down to width w (keeping the aspect ratio) by averaging
+// the source pixels covered by each destination pixel.
+func resize(src image.Image, w int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	h := sh * w / sw
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*sh/h
+		y1 := b.Min.Y + (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*sw/w
+			x1 := b.Min.X + (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,50 @@
+package media
+
+import (
+	"sort"
+	"strings"
+)
+
+// Type describes the container format of a video file.
+type Type struct {
+	// Ext is the file extension (including the dot) videos are served with.
+	Ext string
+	// MIMEType is the Content-Type of the container.
+	MIMEType string
+	// Codecs is an optional RFC 6381 codecs hint (such as "avc1.64001e").
+	Codecs string
+}
+
+// types maps supported file extensions to their container Type.
+var types = map[string]Type{
+	".mp4":  {Ext: ".mp4", MIMEType: "video/mp4"},
+	".m4v":  {Ext: ".m4v", MIMEType: "video/mp4"},
+	".mov":  {Ext: ".mov", MIMEType: "video/quicktime"},
+	".webm": {Ext: ".webm", MIMEType: "video/webm"},
+	".mkv":  {Ext: ".mkv", MIMEType: "video/x-matroska"},
+	".ogv":  {Ext: ".ogv", MIMEType: "video/ogg"},
+}
+
+// TypeByExt returns the Type for a file extension (case insensitive).
+func TypeByExt(ext string) (Type, bool) {
+	t, ok := types[strings.ToLower(ext)]
+	return t, ok
+}
+
+// Exts returns the sorted extensions (without dots) of all supported types.
+func Exts() []string {
+	exts := make([]string, 0, len(types))
+	for ext := range types {
+		exts = append(exts, ext[1:])
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// ContentType returns the MIME type including the codecs parameter if known.
+func (t Type) ContentType() string {
+	if len(t.Codecs) == 0 {
+		return t.MIMEType
+	}
+	return t.MIMEType + "; codecs=\"" + t.Codecs + "\""
+}
@@ -1,7 +1,15 @@
 package media
 
 import (
-	"os"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
 	"path"
 	"strings"
 	"time"
@@ -14,19 +22,49 @@ type Video struct {
 	ID          string
 	Title       string
 	Album       string
+	Track       int
 	Description string
-	Thumb       []byte
-	ThumbType   string
-	Modified    string
-	Size        int64
-	Path        string
-	Timestamp   time.Time
+	// ThumbPath is the file the thumbnail is read from (the video itself for
+	// embedded pictures)
+	ThumbPath string
+	ThumbType string
+	ThumbHash string
+	Modified  string
+	Size      int64
+	Path      string
+	Timestamp time.Time
+	// Published is when a scheduled video becomes visible (zero if it isn't
+	// scheduled)
+	Published  time.Time
+	Type       Type
+	Hash       string
+	Visibility string
+	// Password isn't stored in the index (it's read again from the path or
+	// sidecar)
+	Password   string `json:"-"`
+	Tags       []string
+	Captions   []*Caption
+	Duration   time.Duration
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	// Playable is false for videos most browsers are unable to play
+	Playable bool
+	// Related lists files other than the video that metadata was read from
+	Related []string
 }
 
 // ParseVideo parses a video file's metadata and returns a Video.
 func ParseVideo(p *Path, name string) (*Video, error) {
+	ext := path.Ext(name)
+	typ, ok := TypeByExt(ext)
+	if !ok {
+		return nil, errors.New("media: unsupported file type")
+	}
 	pth := path.Join(p.Path, name)
-	f, err := os.Open(pth)
+	s := p.storage()
+	f, err := s.Open(pth)
 	if err != nil {
 		return nil, err
 	}
@@ -38,40 +76,263 @@ func ParseVideo(p *Path, name string) (*Video, error) {
 	size := info.Size()
 	timestamp := info.ModTime()
 	modified := timestamp.Format("2006-01-02 03:04 PM")
-	// ID is name without extension
-	idx := strings.LastIndex(name, ".")
-	if idx == -1 {
-		idx = len(name)
+	hash, err := contentHash(f, size)
+	if err != nil {
+		return nil, err
 	}
-	id := name[:idx]
-	if len(p.Prefix) > 0 {
-		// if there's a prefix prepend it to the ID
-		id = path.Join(p.Prefix, name[:idx])
+	// ID is name (including any subdirectories) without extension
+	id := strings.TrimSuffix(name, ext)
+	if p.IDMode == IDHash {
+		id = hash[:16]
+	}
+	v := &Video{
+		ID:         prefixID(p, id),
+		Title:      path.Base(name),
+		Modified:   modified,
+		Size:       size,
+		Path:       pth,
+		Timestamp:  timestamp,
+		Type:       typ,
+		Hash:       hash,
+		Visibility: p.Visibility,
+		Password:   p.Password,
+	}
+	if typ.MIMEType == "video/mp4" || typ.MIMEType == "video/quicktime" {
+		info, err := ReadMP4Info(f, size)
+		if err == nil {
+			v.setMP4Info(info)
+		}
+	}
+	v.Playable = isPlayable(v)
+	// rewind after reading MP4 info
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
 	}
 	m, err := tag.ReadFrom(f)
+	// Not every container has tags that can be read so the filename is used
+	// as the title instead
+	if err == nil {
+		// Default title is filename
+		if len(m.Title()) > 0 {
+			v.Title = m.Title()
+		}
+		v.Album = m.Album()
+		v.Track, _ = m.Track()
+		v.Description = m.Comment()
+		// Add thumbnail (if exists)
+		pic := m.Picture()
+		if pic != nil {
+			v.setThumb(pth, pic.MIMEType, pic.Data)
+		}
+	}
+	// Look for captions and images beside the video
+	names, err := s.ReadDir(path.Dir(pth))
 	if err != nil {
 		return nil, err
 	}
-	title := m.Title()
-	// Default title is filename
-	if title == "" {
-		title = name
+	v.Captions = findCaptions(pth, names)
+	for _, c := range v.Captions {
+		v.Related = append(v.Related, c.Path)
 	}
-	v := &Video{
-		ID:          id,
-		Title:       title,
-		Album:       m.Album(),
-		Description: m.Comment(),
-		Modified:    modified,
-		Size:        size,
-		Path:        pth,
-		Timestamp:   timestamp,
-	}
-	// Add thumbnail (if exists)
-	pic := m.Picture()
-	if pic != nil {
-		v.Thumb = pic.Data
-		v.ThumbType = pic.MIMEType
+	if len(v.ThumbPath) == 0 {
+		// fall back to images when there's no embedded picture
+		tp := findThumb(pth, names)
+		if len(tp) > 0 {
+			b, err := readFile(s, tp)
+			if err == nil {
+				v.setThumb(tp, mime.TypeByExtension(path.Ext(tp)), b)
+				v.Related = append(v.Related, tp)
+			}
+		}
+	}
+	// Sidecar metadata overrides embedded tags
+	sc, err := readSidecar(s, pth)
+	if err != nil {
+		log.Println("Sidecar error:", sidecarPath(pth), err)
+	} else if sc != nil {
+		v.Related = append(v.Related, sidecarPath(pth))
+		err = sc.apply(s, p.Path, v)
+		if err != nil {
+			log.Println("Sidecar error:", sidecarPath(pth), err)
+		}
+		if p.IDMode == IDSidecar && len(sc.ID) > 0 {
+			if validID(sc.ID) {
+				v.ID = prefixID(p, sc.ID)
+			} else {
+				log.Println("Sidecar error:", sidecarPath(pth), "invalid id", sc.ID)
+			}
+		}
 	}
 	return v, nil
 }
+
+// setThumb sets the thumbnail of v to be read from file fp. Only a hash of
+// the data is kept so thumbnails don't need to be held in memory.
+func (v *Video) setThumb(fp, typ string, data []byte) {
+	v.ThumbPath = fp
+	v.ThumbType = typ
+	v.ThumbHash = thumbHash(data)
+}
+
+// prefixID prepends the prefix of library path p to a video ID.
+func prefixID(p *Path, id string) string {
+	if len(p.Prefix) > 0 {
+		return path.Join(p.Prefix, id)
+	}
+	return id
+}
+
+// mp4ScheduleMargin is how far in the future the creation time of an MP4 file
+// has to be to schedule the video, since camera clocks are often set to the
+// wrong time zone.
+const mp4ScheduleMargin = 24 * time.Hour
+
+// setMP4Info sets the technical details of v from MP4 boxes.
+func (v *Video) setMP4Info(info *MP4Info) {
+	if info.Created.After(time.Now().Add(mp4ScheduleMargin)) {
+		// a creation time well in the future schedules the video (a camera
+		// clock that's merely off shouldn't hide it)
+		v.Published = info.Created
+		v.Timestamp = info.Created
+		v.Modified = info.Created.Format("2006-01-02 03:04 PM")
+	}
+	v.Duration = info.Duration
+	v.Width = info.Width
+	v.Height = info.Height
+	v.VideoCodec = info.VideoCodec
+	v.AudioCodec = info.AudioCodec
+	// only give browsers a codecs hint when the full codec strings are known
+	// since an incomplete hint may cause them to skip the source
+	codecs := []string{}
+	for _, c := range []string{info.VideoCodec, info.AudioCodec} {
+		if strings.Contains(c, ".") || c == "opus" || c == "flac" {
+			codecs = append(codecs, c)
+		} else if len(c) > 0 {
+			return
+		}
+	}
+	v.Type.Codecs = strings.Join(codecs, ", ")
+}
+
+// browser playable codecs (prefix of the RFC 6381 codec string)
+var (
+	playableVideo = []string{"avc1", "avc3", "vp08", "vp09", "av01"}
+	playableAudio = []string{"mp4a", "opus", "flac"}
+)
+
+// isPlayable returns true if most browsers should be able to play v.
+func isPlayable(v *Video) bool {
+	switch v.Type.MIMEType {
+	case "video/webm", "video/ogg":
+		return true
+	case "video/x-matroska":
+		return false
+	}
+	if len(v.VideoCodec) == 0 {
+		// codecs are unknown so assume MP4 is playable
+		return v.Type.MIMEType == "video/mp4"
+	}
+	if !hasCodecPrefix(v.VideoCodec, playableVideo) {
+		return false
+	}
+	return len(v.AudioCodec) == 0 || hasCodecPrefix(v.AudioCodec, playableAudio)
+}
+
+// hasCodecPrefix returns true if codec begins with any of prefixes.
+func hasCodecPrefix(codec string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(codec, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Length returns the duration formatted as h:mm:ss (or m:ss).
+func (v *Video) Length() string {
+	d := v.Duration.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := int(d % time.Minute / time.Second)
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// Listed returns true if the video should appear in playlists and feeds.
+func (v *Video) Listed() bool {
+	if v.Visibility == Unlisted || v.Visibility == Private {
+		return false
+	}
+	return v.Released()
+}
+
+// Released returns true once a scheduled video has been published.
+func (v *Video) Released() bool {
+	return !time.Now().Before(v.Published)
+}
+
+// Token returns the token granting access to a private video (empty if the
+// video has no password). Tokens are keyed with the secret of the server so
+// they can't be made from the password alone.
+func (v *Video) Token(key []byte) string {
+	if len(v.Password) == 0 {
+		return ""
+	}
+	return keyedHash(key, v.ID+"\x00"+v.Password)[:32]
+}
+
+// Authorized returns true if a password or token grants access to the video.
+func (v *Video) Authorized(key []byte, secret string) bool {
+	if v.Visibility != Private {
+		return true
+	}
+	token := v.Token(key)
+	if len(token) == 0 || len(secret) == 0 {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(v.Password)) == 1
+}
+
+// keyedHash returns the hex encoded HMAC-SHA256 of s with key.
+func keyedHash(key []byte, s string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Caption returns the caption track for a language.
+func (v *Video) Caption(lang string) (*Caption, bool) {
+	for _, c := range v.Captions {
+		if c.Lang == lang {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// IsRelated returns true if file path fp contains metadata for the video,
+// such as a sidecar file sharing the same name or a folder image.
+func (v *Video) IsRelated(fp string) bool {
+	if fp == v.Path {
+		return false
+	}
+	for _, r := range v.Related {
+		if fp == r {
+			return true
+		}
+	}
+	if path.Dir(fp) != path.Dir(v.Path) {
+		return false
+	}
+	if isFolderThumb(path.Base(fp)) {
+		return true
+	}
+	base := strings.TrimSuffix(path.Base(v.Path), path.Ext(v.Path))
+	return strings.HasPrefix(path.Base(fp), base+".")
+}
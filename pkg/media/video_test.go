@@ -0,0 +1,38 @@
+package media
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetMP4InfoSchedule(t *testing.T) {
+	now := time.Now()
+	mtime := now.Add(-48 * time.Hour)
+	tests := []struct {
+		name      string
+		created   time.Time
+		scheduled bool
+	}{
+		{"no creation time", time.Time{}, false},
+		{"before mtime", mtime.Add(-time.Hour), false},
+		{"after mtime", mtime.Add(time.Hour), false},
+		// camera clocks in the wrong time zone
+		{"hours ahead", now.Add(12 * time.Hour), false},
+		{"days ahead", now.Add(72 * time.Hour), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Video{Timestamp: mtime}
+			v.setMP4Info(&MP4Info{Created: tt.created})
+			if v.Released() == tt.scheduled {
+				t.Errorf("got released %v", v.Released())
+			}
+			if tt.scheduled && !v.Timestamp.Equal(tt.created) {
+				t.Errorf("got timestamp %v, want %v", v.Timestamp, tt.created)
+			}
+			if !tt.scheduled && !v.Timestamp.Equal(mtime) {
+				t.Errorf("got timestamp %v, want the file mtime", v.Timestamp)
+			}
+		})
+	}
+}